@@ -0,0 +1,458 @@
+package quicpipe
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Usage is the traffic forwarded to an association.
+type Usage struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// Quota limits the traffic forwarded to an association. The zero value is
+// unlimited.
+type Quota struct {
+	// MaxBytes forwarded in total, unlimited if zero. Once exceeded,
+	// forwarding stops.
+	MaxBytes uint64
+
+	// Rate of bytes forwarded per second, unlimited if zero. Packets over
+	// the rate are dropped. Burst bytes are allowed at once, a second's
+	// worth (but at least one packet) if zero.
+	Rate  float64
+	Burst int
+}
+
+func (q Quota) limited() bool {
+	return q.MaxBytes > 0 || q.Rate > 0
+}
+
+// UsageHarvester is implemented by the eBPF XDP filter in the xdp package.
+type UsageHarvester interface {
+	// HarvestUsage calls fn with the packets and bytes redirected for each
+	// CID since the last harvest.
+	HarvestUsage(fn func(cid []byte, packets, bytes uint64)) error
+}
+
+// accountingMaxEntries bounds the number of associations and sessions an
+// Accounting keeps.
+const accountingMaxEntries = 1024 * 1024
+
+type accountingEntry struct {
+	// key in entries, or in sessions if session is set
+	key     string
+	session bool
+
+	// element in the Accounting's lru
+	element *list.Element
+
+	usage Usage
+	quota Quota
+
+	bucket *tokenBucket
+
+	// exceeded is set once MaxBytes is exceeded
+	exceeded bool
+
+	// throttled is set while over the rate
+	throttled      bool
+	throttledUntil time.Time
+}
+
+// Accounting counts the traffic forwarded to each association, and enforces
+// their quotas. Associations are identified by their first connection ID.
+// Associations with a Session are accounted together, against the quota of
+// the first of them accounted for.
+//
+// Once a million associations and sessions are kept, the least recently
+// accounted for is evicted, losing its usage. Use Range and Forget to bill
+// and remove associations that are gone.
+type Accounting struct {
+	// OnQuotaExceeded, if not nil, is called when an association or
+	// session exceeds its MaxBytes, or starts being throttled due to its
+	// Rate.
+	OnQuotaExceeded func(association Association, usage Usage)
+
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*accountingEntry
+	sessions   map[string]*accountingEntry
+
+	// lru holds the entries and sessions, most recently used first
+	lru list.List
+}
+
+func NewAccounting() *Accounting {
+	return &Accounting{
+		maxEntries: accountingMaxEntries,
+		entries:    make(map[string]*accountingEntry),
+		sessions:   make(map[string]*accountingEntry),
+	}
+}
+
+// entry returns the entry of the association or its session, updating the
+// quota of an association's entry. A session's entry keeps the quota it was
+// created with, so that its members share one token bucket. Must be called
+// with the lock held.
+func (a *Accounting) entry(association Association, now time.Time) *accountingEntry {
+	entries, s := a.entries, ""
+
+	if association.Session != "" {
+		entries, s = a.sessions, association.Session
+	} else {
+		s = hex.EncodeToString(association.ConnectionIDs[0])
+	}
+
+	entry, ok := entries[s]
+	if ok {
+		a.lru.MoveToFront(entry.element)
+	} else {
+		if len(a.entries)+len(a.sessions) >= a.maxEntries {
+			a.evict()
+		}
+
+		entry = &accountingEntry{
+			key:     s,
+			session: association.Session != "",
+			quota:   association.Quota,
+		}
+		entry.element = a.lru.PushFront(entry)
+		entry.bucket = entry.newBucket(now)
+
+		entries[s] = entry
+	}
+
+	if !entry.session && entry.quota != association.Quota {
+		entry.quota = association.Quota
+		entry.bucket = entry.newBucket(now)
+	}
+
+	return entry
+}
+
+// newBucket returns a token bucket for the entry's Rate, or nil if it has
+// none.
+func (e *accountingEntry) newBucket(now time.Time) *tokenBucket {
+	if e.quota.Rate <= 0 {
+		return nil
+	}
+
+	burst := e.quota.Burst
+	if burst == 0 {
+		burst = int(e.quota.Rate)
+		if burst < maxPacketSize {
+			burst = maxPacketSize
+		}
+	}
+
+	return newTokenBucket(e.quota.Rate, burst, now)
+}
+
+// evict removes the least recently used entry. Must be called with the lock
+// held.
+func (a *Accounting) evict() {
+	element := a.lru.Back()
+	if element == nil {
+		return
+	}
+
+	a.remove(element.Value.(*accountingEntry))
+}
+
+// remove removes the entry. Must be called with the lock held.
+func (a *Accounting) remove(entry *accountingEntry) {
+	a.lru.Remove(entry.element)
+
+	if entry.session {
+		delete(a.sessions, entry.key)
+	} else {
+		delete(a.entries, entry.key)
+	}
+}
+
+// checkMaxBytes marks the entry as exceeded if it is over MaxBytes, returning
+// true the first time. Must be called with the lock held.
+func (e *accountingEntry) checkMaxBytes() bool {
+	if e.exceeded || e.quota.MaxBytes == 0 || e.usage.Bytes <= e.quota.MaxBytes {
+		return false
+	}
+
+	e.exceeded = true
+
+	return true
+}
+
+func (a *Accounting) exceeded(association Association, usage Usage) {
+	if a.OnQuotaExceeded != nil {
+		a.OnQuotaExceeded(association, usage)
+	}
+}
+
+// forward accounts for a packet of n bytes to the association, returning
+// false if it must be dropped due to the association's quota.
+func (a *Accounting) forward(association Association, n int, now time.Time) bool {
+	if len(association.ConnectionIDs) == 0 {
+		return true
+	}
+
+	allowed, exceeded, usage := func() (bool, bool, Usage) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		entry := a.entry(association, now)
+
+		if entry.exceeded {
+			return false, false, entry.usage
+		}
+
+		if entry.quota.MaxBytes > 0 && entry.usage.Bytes+uint64(n) > entry.quota.MaxBytes {
+			entry.exceeded = true
+
+			return false, true, entry.usage
+		}
+
+		if entry.bucket != nil && !entry.bucket.allow(now, float64(n)) {
+			exceeded := !entry.throttled
+			entry.throttled = true
+
+			return false, exceeded, entry.usage
+		}
+
+		entry.throttled = false
+		entry.usage.Packets += 1
+		entry.usage.Bytes += uint64(n)
+
+		return true, false, entry.usage
+	}()
+
+	if exceeded {
+		a.exceeded(association, usage)
+	}
+
+	return allowed
+}
+
+// allowed returns false while the association is over its quota.
+func (a *Accounting) allowed(association Association, now time.Time) bool {
+	if len(association.ConnectionIDs) == 0 || !association.Quota.limited() {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry := a.entry(association, now)
+
+	return !entry.exceeded && !now.Before(entry.throttledUntil)
+}
+
+// account adds traffic that was already forwarded, such as by the XDP
+// filter, returning false if the association is now over its quota.
+func (a *Accounting) account(association Association, usage Usage, now time.Time) bool {
+	allowed, exceeded, total := func() (bool, bool, Usage) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		entry := a.entry(association, now)
+
+		entry.usage.Packets += usage.Packets
+		entry.usage.Bytes += usage.Bytes
+
+		exceeded := entry.checkMaxBytes()
+
+		if entry.bucket != nil {
+			if debt := entry.bucket.take(now, float64(usage.Bytes)); debt > 0 {
+				exceeded = exceeded || !entry.throttled
+				entry.throttled = true
+				entry.throttledUntil = now.Add(debt)
+			} else {
+				entry.throttled = false
+			}
+		}
+
+		return !entry.exceeded && !entry.throttled, exceeded, entry.usage
+	}()
+
+	if exceeded {
+		a.exceeded(association, total)
+	}
+
+	return allowed
+}
+
+// Harvest adds the traffic redirected by the XDP filter to the associations
+// in the store. The redirects of associations over their quota are removed;
+// a Repopulator with the same Accounting does not re-insert them until the
+// association is allowed again. Call it regularly, as the filter's counters
+// are kept in a LRU map.
+func (a *Accounting) Harvest(ctx context.Context, store Store, xdp interface {
+	XDPRedirector
+	UsageHarvester
+}) error {
+	harvested := make(map[string]Usage)
+
+	err := xdp.HarvestUsage(func(cid []byte, packets, bytes uint64) {
+		s := string(cid)
+
+		usage := harvested[s]
+		usage.Packets += packets
+		usage.Bytes += bytes
+		harvested[s] = usage
+	})
+	if err != nil {
+		return err
+	}
+
+	// CIDs of the same association are accounted together
+	associations := make(map[string]Association)
+	usages := make(map[string]Usage)
+
+	var firstErr error
+
+	for cid, usage := range harvested {
+		association, err := store.GetAssociation(ctx, []byte(cid))
+		if errors.Is(err, ErrAssociationNotFound) {
+			continue
+		} else if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		if len(association.ConnectionIDs) == 0 {
+			continue
+		}
+
+		s := string(association.ConnectionIDs[0])
+
+		associations[s] = association
+
+		total := usages[s]
+		total.Packets += usage.Packets
+		total.Bytes += usage.Bytes
+		usages[s] = total
+	}
+
+	now := time.Now()
+
+	for s, association := range associations {
+		if a.account(association, usages[s], now) {
+			continue
+		}
+
+		if err := removeRedirects(xdp, association.Addr, association.ConnectionIDs...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Usage returns the traffic forwarded to the association identified by its
+// first connection ID.
+func (a *Accounting) Usage(cid []byte) Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.entries[hex.EncodeToString(cid)]
+	if !ok {
+		return Usage{}
+	}
+
+	return entry.usage
+}
+
+// SessionUsage returns the traffic forwarded to the associations of the
+// session.
+func (a *Accounting) SessionUsage(session string) Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.sessions[session]
+	if !ok {
+		return Usage{}
+	}
+
+	return entry.usage
+}
+
+// Range calls fn with the usage of each association without a session,
+// identified by its first connection ID.
+func (a *Accounting) Range(fn func(cid []byte, usage Usage)) {
+	type item struct {
+		cid   []byte
+		usage Usage
+	}
+
+	var items []item
+
+	a.mu.Lock()
+	for s, entry := range a.entries {
+		cid, err := hex.DecodeString(s)
+		if err != nil {
+			continue
+		}
+
+		items = append(items, item{cid: cid, usage: entry.usage})
+	}
+	a.mu.Unlock()
+
+	for _, item := range items {
+		fn(item.cid, item.usage)
+	}
+}
+
+// Forget removes the usage and quota state of the association identified by
+// its first connection ID, such as once it was billed and unregistered.
+func (a *Accounting) Forget(cid []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if entry, ok := a.entries[hex.EncodeToString(cid)]; ok {
+		a.remove(entry)
+	}
+}
+
+// RangeSessions calls fn with the usage of each session.
+func (a *Accounting) RangeSessions(fn func(session string, usage Usage)) {
+	a.mu.Lock()
+	usages := make(map[string]Usage, len(a.sessions))
+
+	for session, entry := range a.sessions {
+		usages[session] = entry.usage
+	}
+	a.mu.Unlock()
+
+	for session, usage := range usages {
+		fn(session, usage)
+	}
+}
+
+// ForgetSession is like Forget, for a session.
+func (a *Accounting) ForgetSession(session string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if entry, ok := a.sessions[session]; ok {
+		a.remove(entry)
+	}
+}
+
+// WithAccounting counts the traffic forwarded to each association and
+// enforces their quotas. It only applies to
+// NewServerConnectionWithOptions.
+func WithAccounting(a *Accounting) Option {
+	return func(c *config) error {
+		c.server.accounting = a
+
+		return nil
+	}
+}
@@ -0,0 +1,187 @@
+package quicpipe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccountingMaxBytes(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	var exceeded []Usage
+
+	accounting := NewAccounting()
+	accounting.OnQuotaExceeded = func(association Association, usage Usage) {
+		exceeded = append(exceeded, usage)
+	}
+
+	association := Association{
+		ConnectionIDs: [][]byte{{1}},
+		Quota:         Quota{MaxBytes: 250},
+	}
+
+	for i := 0; i < 2; i += 1 {
+		if !accounting.forward(association, 100, now) {
+			t.Fatalf("expected packet %d to be forwarded", i)
+		}
+	}
+
+	if accounting.forward(association, 100, now) {
+		t.Fatal("expected packet over MaxBytes to be dropped")
+	}
+
+	if accounting.forward(association, 10, now) {
+		t.Fatal("expected packets to be dropped once MaxBytes is exceeded")
+	}
+
+	if len(exceeded) != 1 || exceeded[0] != (Usage{Packets: 2, Bytes: 200}) {
+		t.Fatalf("expected OnQuotaExceeded once with the usage, got %v", exceeded)
+	}
+
+	if usage := accounting.Usage([]byte{1}); usage != (Usage{Packets: 2, Bytes: 200}) {
+		t.Fatalf("unexpected usage %v", usage)
+	}
+
+	if accounting.allowed(association, now) {
+		t.Fatal("expected association to not be allowed")
+	}
+
+	accounting.Forget([]byte{1})
+
+	if !accounting.forward(association, 100, now) {
+		t.Fatal("expected forgotten association to be forwarded")
+	}
+}
+
+func TestAccountingRate(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	accounting := NewAccounting()
+
+	association := Association{
+		ConnectionIDs: [][]byte{{1}},
+		Quota:         Quota{Rate: 1000, Burst: 1000},
+	}
+
+	if !accounting.forward(association, 1000, now) {
+		t.Fatal("expected burst to be forwarded")
+	}
+
+	if accounting.forward(association, 100, now) {
+		t.Fatal("expected packet over the rate to be dropped")
+	}
+
+	if !accounting.forward(association, 100, now.Add(100*time.Millisecond)) {
+		t.Fatal("expected packet to be forwarded after refilling")
+	}
+
+	// traffic forwarded by the XDP filter puts the bucket in debt
+	if accounting.account(association, Usage{Packets: 1, Bytes: 1000}, now.Add(100*time.Millisecond)) {
+		t.Fatal("expected association to be throttled")
+	}
+
+	if accounting.allowed(association, now.Add(500*time.Millisecond)) {
+		t.Fatal("expected association to be throttled until out of debt")
+	}
+
+	if !accounting.allowed(association, now.Add(1100*time.Millisecond)) {
+		t.Fatal("expected association to be allowed once out of debt")
+	}
+}
+
+func TestAccountingSession(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	accounting := NewAccounting()
+
+	quota := Quota{MaxBytes: 150}
+
+	dialer := Association{ConnectionIDs: [][]byte{{1}}, Session: "s", Quota: quota}
+	accepter := Association{ConnectionIDs: [][]byte{{2}}, Session: "s", Quota: quota}
+
+	if !accounting.forward(dialer, 100, now) {
+		t.Fatal("expected packet to the dialer to be forwarded")
+	}
+
+	if accounting.forward(accepter, 100, now) {
+		t.Fatal("expected the session to share its quota")
+	}
+
+	if usage := accounting.SessionUsage("s"); usage != (Usage{Packets: 1, Bytes: 100}) {
+		t.Fatalf("unexpected session usage %v", usage)
+	}
+
+	unlimited := Association{ConnectionIDs: [][]byte{{3}}}
+
+	for i := 0; i < 10; i += 1 {
+		if !accounting.forward(unlimited, 1000, now) {
+			t.Fatal("expected association without quota to be forwarded")
+		}
+	}
+}
+
+func TestAccountingSessionQuota(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	accounting := NewAccounting()
+
+	dialer := Association{ConnectionIDs: [][]byte{{1}}, Session: "s", Quota: Quota{Rate: 1000, Burst: 1000}}
+	accepter := Association{ConnectionIDs: [][]byte{{2}}, Session: "s", Quota: Quota{Rate: 2000, Burst: 2000}}
+
+	if !accounting.forward(dialer, 1000, now) {
+		t.Fatal("expected burst to be forwarded")
+	}
+
+	// a member with another quota does not reset the session's bucket
+	if accounting.forward(accepter, 100, now) {
+		t.Fatal("expected the session's bucket to be empty")
+	}
+
+	if accounting.forward(dialer, 100, now) {
+		t.Fatal("expected the session's bucket to stay empty")
+	}
+
+	if !accounting.forward(accepter, 100, now.Add(100*time.Millisecond)) {
+		t.Fatal("expected the session's bucket to refill at the first member's rate")
+	}
+}
+
+func TestAccountingEvict(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	accounting := NewAccounting()
+	accounting.maxEntries = 2
+
+	old := Association{ConnectionIDs: [][]byte{{1}}, Quota: Quota{MaxBytes: 100}}
+	recent := Association{ConnectionIDs: [][]byte{{2}}}
+	session := Association{ConnectionIDs: [][]byte{{3}}, Session: "s"}
+
+	accounting.forward(old, 100, now)
+	accounting.forward(recent, 100, now)
+
+	if accounting.forward(old, 100, now) {
+		t.Fatal("expected packet over MaxBytes to be dropped")
+	}
+
+	// evicts the least recently used entry
+	accounting.forward(session, 100, now)
+
+	if usage := accounting.Usage([]byte{2}); usage != (Usage{}) {
+		t.Fatalf("expected the least recently used entry to be evicted, got %v", usage)
+	}
+
+	if usage := accounting.Usage([]byte{1}); usage != (Usage{Packets: 1, Bytes: 100}) {
+		t.Fatalf("expected the recently used entry to be kept, got %v", usage)
+	}
+
+	if accounting.allowed(old, now) {
+		t.Fatal("expected the kept entry to stay over its quota")
+	}
+
+	accounting.Forget([]byte{1})
+	accounting.ForgetSession("s")
+
+	if len(accounting.entries) != 0 || len(accounting.sessions) != 0 || accounting.lru.Len() != 0 {
+		t.Fatalf("expected no entries, got %d, %d and %d", len(accounting.entries), len(accounting.sessions), accounting.lru.Len())
+	}
+}
@@ -0,0 +1,424 @@
+package quicpipe
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// batchSize is the number of messages read or written per syscall.
+	batchSize = 64
+
+	// batchQueueSize is the number of packets queued for the HTTP/3 server.
+	batchQueueSize = 1024
+
+	// gsoBufferSize fits the largest UDP datagram, coalesced by GRO or to
+	// be split by GSO.
+	gsoBufferSize = 64 * 1024
+
+	// maxGSOSegments is the most packets sent in one GSO message.
+	maxGSOSegments = 64
+)
+
+// batchIO is implemented by ipv4.PacketConn and ipv6.PacketConn, whose
+// messages are the same type.
+type batchIO interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchPacket is a packet for the HTTP/3 server.
+type batchPacket struct {
+	buffer *[]byte
+	n      int
+	addr   net.Addr
+}
+
+// packetQueue queues packets for the HTTP/3 server from one or more
+// forwarders, and returns them from ReadFrom.
+type packetQueue struct {
+	packets chan batchPacket
+	buffers sync.Pool
+
+	readDeadline deadline
+
+	// err is set before failed is closed
+	err      error
+	failOnce sync.Once
+	failed   chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPacketQueue() *packetQueue {
+	q := &packetQueue{
+		packets: make(chan batchPacket, batchQueueSize),
+		failed:  make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+
+	q.buffers.New = func() interface{} {
+		buffer := make([]byte, maxPacketSize)
+		return &buffer
+	}
+
+	return q
+}
+
+// deliver queues a copy of the packet, dropping it if the HTTP/3 server is
+// falling behind.
+func (q *packetQueue) deliver(p []byte, addr net.Addr) {
+	buffer := q.buffers.Get().(*[]byte)
+	n := copy(*buffer, p)
+
+	select {
+	case q.packets <- batchPacket{buffer: buffer, n: n, addr: addr}:
+	default:
+		q.buffers.Put(buffer)
+	}
+}
+
+// fail makes ReadFrom return the first error of any forwarder.
+func (q *packetQueue) fail(err error) {
+	q.failOnce.Do(func() {
+		q.err = err
+		close(q.failed)
+	})
+}
+
+func (q *packetQueue) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-q.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+
+	default:
+		// continue
+	}
+
+	select {
+	case packet := <-q.packets:
+		n := copy(p, (*packet.buffer)[:packet.n])
+		q.buffers.Put(packet.buffer)
+
+		return n, packet.addr, nil
+
+	case <-q.failed:
+		return 0, nil, q.err
+
+	case <-q.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+
+	case <-q.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (q *packetQueue) close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+}
+
+// batchForwarder reads, classifies and forwards batches of packets from one
+// socket, delivering packets for the HTTP/3 server to a queue.
+type batchForwarder struct {
+	*serverConn
+
+	io    batchIO
+	gro   bool
+	queue *packetQueue
+
+	writer *batchWriter
+}
+
+func newBatchForwarder(sc *serverConn, conn *net.UDPConn, queue *packetQueue) *batchForwarder {
+	var bio batchIO
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		bio = ipv4.NewPacketConn(conn)
+	} else {
+		bio = ipv6.NewPacketConn(conn)
+	}
+
+	return &batchForwarder{
+		serverConn: sc,
+		io:         bio,
+		gro:        enableGRO(conn),
+		queue:      queue,
+		writer:     newBatchWriter(bio, supportsGSO(conn), sc.metrics),
+	}
+}
+
+func (f *batchForwarder) run() {
+	f.queue.fail(f.forward())
+}
+
+// forward forwards packets until an error.
+func (f *batchForwarder) forward() error {
+	bufferSize := maxPacketSize
+	if f.gro {
+		bufferSize = gsoBufferSize
+	}
+
+	ms := make([]ipv4.Message, batchSize)
+
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, bufferSize)}
+
+		if f.gro {
+			ms[i].OOB = make([]byte, groControlSize)
+		}
+	}
+
+	for {
+		n, err := f.io.ReadBatch(ms, 0)
+		if err != nil {
+			return err
+		}
+
+		for i := range ms[:n] {
+			m := &ms[i]
+
+			data := m.Buffers[0][:m.N]
+
+			size := len(data)
+			if f.gro {
+				if segment := groSegmentSize(m.OOB[:m.NN]); segment > 0 {
+					size = segment
+				}
+			}
+
+			// coalesced packets are split
+			for len(data) > 0 {
+				packet := data
+				if len(packet) > size {
+					packet = packet[:size]
+				}
+
+				data = data[len(packet):]
+
+				if err := f.handle(packet, m.Addr); err != nil {
+					return err
+				}
+			}
+		}
+
+		// before the buffers are read into again
+		if err := f.writer.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *batchForwarder) handle(p []byte, addr net.Addr) error {
+	to, local, err := f.classify(p, addr)
+	if err != nil {
+		return err
+	}
+
+	if local {
+		f.queue.deliver(p, addr)
+		return nil
+	}
+
+	if to == nil {
+		return nil
+	}
+
+	return f.writer.add(p, to)
+}
+
+type batchServerConn struct {
+	*serverConn
+
+	udp   *net.UDPConn
+	queue *packetQueue
+}
+
+// NewBatchServerConnection is like NewServerConnectionWithOptions, but is a
+// separate forwarding engine which reads and writes packets in batches, with
+// recvmmsg and sendmmsg on Linux, and coalesces them with UDP GRO and GSO
+// where the kernel supports it. Elsewhere one packet is read per syscall. Packets for
+// the HTTP/3 server are queued for ReadFrom, and dropped if it falls behind.
+func NewBatchServerConnection(ctx context.Context, conn *net.UDPConn, store Store, options ...Option) (ServerConnection, error) {
+	sc, err := newServerConn(ctx, conn, store, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &batchServerConn{
+		serverConn: sc,
+		udp:        conn,
+		queue:      newPacketQueue(),
+	}
+
+	go newBatchForwarder(sc, conn, c.queue).run()
+
+	return c, nil
+}
+
+func (c *batchServerConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return c.queue.ReadFrom(p)
+}
+
+func (c *batchServerConn) SetReadDeadline(t time.Time) error {
+	c.queue.readDeadline.set(t)
+
+	return nil
+}
+
+func (c *batchServerConn) SetDeadline(t time.Time) error {
+	c.queue.readDeadline.set(t)
+
+	return c.udp.SetWriteDeadline(t)
+}
+
+func (c *batchServerConn) Close() error {
+	c.queue.close()
+
+	return c.udp.Close()
+}
+
+// batchMessage describes a message of a batchWriter.
+type batchMessage struct {
+	segments int
+	size     int
+	bytes    int
+}
+
+// batchWriter collects forwarded packets, and writes them in batches. With
+// GSO, consecutive packets of the same size to the same address are sent as
+// one message.
+type batchWriter struct {
+	io      batchIO
+	gso     bool
+	metrics Metrics
+
+	ms       []ipv4.Message
+	messages []batchMessage
+	n        int
+
+	// gsoBuffers hold the coalesced packets of each message
+	gsoBuffers [][]byte
+}
+
+func newBatchWriter(bio batchIO, gso bool, metrics Metrics) *batchWriter {
+	w := &batchWriter{
+		io:       bio,
+		gso:      gso,
+		metrics:  metrics,
+		ms:       make([]ipv4.Message, batchSize),
+		messages: make([]batchMessage, batchSize),
+	}
+
+	if gso {
+		w.gsoBuffers = make([][]byte, batchSize)
+
+		for i := range w.ms {
+			w.gsoBuffers[i] = make([]byte, 0, gsoBufferSize)
+			w.ms[i].OOB = make([]byte, 0, gsoControlSize)
+		}
+	}
+
+	return w
+}
+
+func sameUDPAddr(a, b net.Addr) bool {
+	if a == b {
+		return true
+	}
+
+	ua, ok := a.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	ub, ok := b.(*net.UDPAddr)
+
+	return ok && ua.Port == ub.Port && ua.IP.Equal(ub.IP)
+}
+
+// add queues a packet to the address. The packet must not change until the
+// next flush.
+func (w *batchWriter) add(p []byte, to net.Addr) error {
+	if w.gso && w.n > 0 {
+		i := w.n - 1
+		last := &w.messages[i]
+
+		// only the last segment may be shorter
+		if sameUDPAddr(w.ms[i].Addr, to) && last.segments < maxGSOSegments && last.bytes%last.size == 0 && len(p) <= last.size && last.bytes+len(p) <= gsoBufferSize {
+			w.gsoBuffers[i] = append(w.gsoBuffers[i], p...)
+			w.ms[i].Buffers[0] = w.gsoBuffers[i]
+
+			last.segments += 1
+			last.bytes += len(p)
+
+			return nil
+		}
+	}
+
+	if w.n == len(w.ms) {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	i := w.n
+	w.n += 1
+
+	buffer := p
+	if w.gso {
+		w.gsoBuffers[i] = append(w.gsoBuffers[i][:0], p...)
+		buffer = w.gsoBuffers[i]
+	}
+
+	w.ms[i].Buffers = [][]byte{buffer}
+	w.ms[i].Addr = to
+	w.messages[i] = batchMessage{
+		segments: 1,
+		size:     len(p),
+		bytes:    len(p),
+	}
+
+	return nil
+}
+
+// flush writes all queued packets.
+func (w *batchWriter) flush() error {
+	ms := w.ms[:w.n]
+
+	for i := range ms {
+		if w.gso {
+			ms[i].OOB = ms[i].OOB[:0]
+
+			if w.messages[i].segments > 1 {
+				ms[i].OOB = gsoControl(ms[i].OOB, w.messages[i].size)
+			}
+		}
+	}
+
+	for len(ms) > 0 {
+		n, err := w.io.WriteBatch(ms, 0)
+		if err != nil {
+			return err
+		}
+
+		ms = ms[n:]
+	}
+
+	for _, message := range w.messages[:w.n] {
+		addMetric(w.metrics, MetricPacketsForwarded, uint64(message.segments))
+		addMetric(w.metrics, MetricBytesForwarded, uint64(message.bytes))
+	}
+
+	w.n = 0
+
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package quicpipe
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// socket options of linux/udp.h
+	udpSegment = 103 // UDP_SEGMENT
+	udpGRO     = 104 // UDP_GRO
+)
+
+var (
+	groControlSize = unix.CmsgSpace(4)
+	gsoControlSize = unix.CmsgSpace(2)
+)
+
+func udpSockopt(conn *net.UDPConn, fn func(fd int) error) bool {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var serr error
+
+	if err := rc.Control(func(fd uintptr) {
+		serr = fn(int(fd))
+	}); err != nil {
+		return false
+	}
+
+	return serr == nil
+}
+
+// enableGRO asks the kernel to coalesce received packets, returning false if
+// it does not support it (before Linux 5.0).
+func enableGRO(conn *net.UDPConn) bool {
+	return udpSockopt(conn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_UDP, udpGRO, 1)
+	})
+}
+
+// supportsGSO returns false if the kernel can't segment sent packets (before
+// Linux 4.18).
+func supportsGSO(conn *net.UDPConn) bool {
+	return udpSockopt(conn, func(fd int) error {
+		_, err := unix.GetsockoptInt(fd, unix.IPPROTO_UDP, udpSegment)
+		return err
+	})
+}
+
+// groSegmentSize returns the size of the packets coalesced into a message, or
+// 0 if it is a single packet.
+func groSegmentSize(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.IPPROTO_UDP && msg.Header.Type == udpGRO && len(msg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+		}
+	}
+
+	return 0
+}
+
+// gsoControl appends a control message splitting the message into packets of
+// the size.
+func gsoControl(oob []byte, size int) []byte {
+	start := len(oob)
+	oob = oob[:start+gsoControlSize]
+
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[start]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+
+	*(*uint16)(unsafe.Pointer(&oob[start+unix.CmsgLen(0)])) = uint16(size)
+
+	return oob
+}
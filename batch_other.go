@@ -0,0 +1,28 @@
+//go:build !linux
+
+package quicpipe
+
+import (
+	"net"
+)
+
+const (
+	groControlSize = 0
+	gsoControlSize = 0
+)
+
+func enableGRO(conn *net.UDPConn) bool {
+	return false
+}
+
+func supportsGSO(conn *net.UDPConn) bool {
+	return false
+}
+
+func groSegmentSize(oob []byte) int {
+	return 0
+}
+
+func gsoControl(oob []byte, size int) []byte {
+	return oob
+}
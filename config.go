@@ -3,12 +3,15 @@ package quicpipe
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"net/http"
 
 	"github.com/lucas-clemente/quic-go"
 )
 
 type config struct {
+	cidlen int
+
 	p2p struct {
 		qcfg *quic.Config
 		tls  *tls.Config
@@ -20,19 +23,51 @@ type config struct {
 	}
 
 	dial struct {
-		fn CreateDialRequestFunc
+		fns []CreateDialRequestFunc
 	}
 
 	accept struct {
-		fn CreateAcceptRequestFunc
+		fns []CreateAcceptRequestFunc
+	}
+
+	direct struct {
+		enabled bool
+	}
+
+	server struct {
+		metrics    Metrics
+		accounting *Accounting
+
+		sourceLimit      *rateLimiter
+		destinationLimit *rateLimiter
+
+		verifySource bool
 	}
 }
 
+// finish applies settings that depend on multiple options.
+func (c *config) finish() {
+	c.p2p.qcfg = StandardQUICConfigWithConnectionIDLength(c.p2p.qcfg, false, c.cidlen)
+	c.relay.qcfg = StandardQUICConfigWithConnectionIDLength(c.relay.qcfg, true, c.cidlen)
+
+	if c.p2p.qcfg.KeepAlivePeriod != 0 {
+		return
+	}
+
+	if c.direct.enabled {
+		c.p2p.qcfg.KeepAlivePeriod = directKeepAlivePeriod
+	} else if len(c.dial.fns) > 1 || len(c.accept.fns) > 1 {
+		c.p2p.qcfg.KeepAlivePeriod = relayKeepAlivePeriod
+	}
+}
+
+var ErrNoRelays = errors.New("quicpipe: no relay request functions")
+
 type Option = func(c *config) error
 
 func WithPointToPointQUICConfig(qcfg *quic.Config, tls *tls.Config) Option {
 	return func(c *config) error {
-		c.p2p.qcfg = StandardQUICConfig(qcfg, false)
+		c.p2p.qcfg = qcfg
 		c.p2p.tls = tls
 
 		return nil
@@ -41,7 +76,7 @@ func WithPointToPointQUICConfig(qcfg *quic.Config, tls *tls.Config) Option {
 
 func WithRelayQUICConfig(qcfg *quic.Config) Option {
 	return func(c *config) error {
-		c.relay.qcfg = StandardQUICConfig(qcfg, true)
+		c.relay.qcfg = qcfg
 
 		return nil
 	}
@@ -55,13 +90,42 @@ func WithRelayTLSConfig(tlsfn func(ctx context.Context, tlscfg *tls.Config) erro
 	}
 }
 
+// WithConnectionIDLength sets the length of connection IDs, between
+// MinQUICConnectionIDLength and MaxQUICConnectionIDLength bytes. The relay and
+// all peers must use the same length, StandardQUICConnectionIDLength by
+// default.
+func WithConnectionIDLength(cidlen int) Option {
+	return func(c *config) error {
+		if err := checkConnectionIDLength(cidlen); err != nil {
+			return err
+		}
+
+		c.cidlen = cidlen
+
+		return nil
+	}
+}
+
 type ResponseHandler = func(ctx context.Context, response *http.Response) error
 
 type CreateDialRequestFunc = func(ctx context.Context, packet []byte, cid []byte) (*http.Request, ResponseHandler, error)
 
 func WithDialRequest(fn CreateDialRequestFunc) Option {
+	return WithDialRequests(fn)
+}
+
+// WithDialRequests registers with an ordered list of relays, one request
+// function each. The initial packet is passed to the first relay that
+// accepts the registration, which is used until it goes silent. The
+// connection then switches to another relay. The accepter should register
+// with the same relays.
+func WithDialRequests(fns ...CreateDialRequestFunc) Option {
 	return func(c *config) error {
-		c.dial.fn = fn
+		if len(fns) == 0 {
+			return ErrNoRelays
+		}
+
+		c.dial.fns = fns
 
 		return nil
 	}
@@ -70,8 +134,31 @@ func WithDialRequest(fn CreateDialRequestFunc) Option {
 type CreateAcceptRequestFunc = func(ctx context.Context, cid []byte) (*http.Request, ResponseHandler, error)
 
 func WithAcceptRequest(fn CreateAcceptRequestFunc) Option {
+	return WithAcceptRequests(fn)
+}
+
+// WithAcceptRequests registers with an ordered list of relays, like
+// WithDialRequests.
+func WithAcceptRequests(fns ...CreateAcceptRequestFunc) Option {
+	return func(c *config) error {
+		if len(fns) == 0 {
+			return ErrNoRelays
+		}
+
+		c.accept.fns = fns
+
+		return nil
+	}
+}
+
+// WithDirectPath lets the peers switch to a direct path by NAT hole punching
+// once the connection is established over the relay. They exchange the
+// addresses the relay reported to them (see ReportReflexiveAddr) and their
+// local addresses, and fall back to the relay whenever the direct path stops
+// working. Both peers must enable it. Listener does not support it.
+func WithDirectPath() Option {
 	return func(c *config) error {
-		c.accept.fn = fn
+		c.direct.enabled = true
 
 		return nil
 	}
@@ -0,0 +1,71 @@
+package quicpipe
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a deadline that can be waited on. The zero value has no
+// deadline.
+type deadline struct {
+	mu sync.Mutex
+
+	timer *time.Timer
+
+	// expired is closed when the deadline has passed
+	expired chan struct{}
+}
+
+func (d *deadline) init() {
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+}
+
+// set sets the deadline, the zero time removes it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.init()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer's function is running or has closed the channel
+		<-d.expired
+	}
+
+	d.timer = nil
+
+	select {
+	case <-d.expired:
+		d.expired = make(chan struct{})
+
+	default:
+		// not expired
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	wait := time.Until(t)
+	if wait <= 0 {
+		close(d.expired)
+		return
+	}
+
+	expired := d.expired
+	d.timer = time.AfterFunc(wait, func() {
+		close(expired)
+	})
+}
+
+// wait returns a channel which is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.init()
+
+	return d.expired
+}
@@ -2,14 +2,11 @@ package quicpipe
 
 import (
 	"context"
-	"crypto/tls"
 	"net"
-	"net/http"
 	"sync/atomic"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/http3"
 )
 
 type dialConn struct {
@@ -18,7 +15,9 @@ type dialConn struct {
 	ctx context.Context
 	cfg *config
 
-	pconn net.PacketConn
+	pconn  net.PacketConn
+	relays *relayPaths
+	direct *directPath
 
 	quicConn      quic.Connection
 	quicEarlyConn quic.EarlyConnection
@@ -53,7 +52,22 @@ func (c *dialConn) EarlyConnection() quic.EarlyConnection {
 }
 
 func (c *dialConn) ReadFrom(p []byte) (int, net.Addr, error) {
-	return c.pconn.ReadFrom(p)
+	for {
+		n, addr, err := c.pconn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		c.relays.receive(addr)
+
+		if c.direct == nil {
+			return n, addr, nil
+		}
+
+		if addr, ok := c.direct.receive(p[:n], addr); ok {
+			return n, addr, nil
+		}
+	}
 }
 
 func (c *dialConn) WriteTo(p []byte, addr net.Addr) (int, error) {
@@ -63,48 +77,55 @@ func (c *dialConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 		return c.writeToInitial(p, addr)
 	}
 
-	return c.pconn.WriteTo(p, addr)
+	if c.direct != nil {
+		addr = c.direct.route(addr)
+	}
+
+	return c.pconn.WriteTo(p, c.relays.route(addr))
 }
 
+// writeToInitial registers with the relays in order. The initial packet is
+// only passed to the first relay that accepts the registration.
 func (c *dialConn) writeToInitial(p []byte, addr net.Addr) (int, error) {
-	req, resh, err := c.cfg.dial.fn(c.ctx, p, c.cfg.p2p.qcfg.ConnectionIDGenerator.(*ConnectionIDGenerator).Key)
-	if err != nil {
-		return 0, err
-	}
+	key := c.cfg.p2p.qcfg.ConnectionIDGenerator.(*ConnectionIDGenerator).Key
+
+	var (
+		packet   = p
+		firstErr error
+	)
 
-	quicrt := &http3.RoundTripper{
-		QuicConfig: c.cfg.relay.qcfg,
-		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, qcfg *quic.Config) (quic.EarlyConnection, error) {
-			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	for i, fn := range c.cfg.dial.fns {
+		err := func() error {
+			ctx, cancel := relayContext(c.ctx, len(c.cfg.dial.fns))
+			defer cancel()
+
+			req, resh, err := fn(ctx, packet, key)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
-			if c.cfg.relay.tls != nil {
-				c.cfg.relay.tls(ctx, tlsCfg)
+			relayAddr, err := relayRequest(withReflexiveAddr(ctx, c.direct), c.cfg, c, req, resh)
+			if err != nil {
+				return err
 			}
 
-			return quic.DialEarlyContext(ctx, c, udpAddr, addr, tlsCfg, qcfg)
-		},
-	}
-
-	quicclient := &http.Client{
-		Transport: quicrt,
-	}
+			c.relays.registered(i, relayAddr)
 
-	resp, err := quicclient.Do(req)
-	if err != nil {
-		return 0, err
-	}
+			return nil
+		}()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
 
-	if err := resh(c.ctx, resp); err != nil {
-		quicrt.Close()
+			continue
+		}
 
-		return 0, err
+		packet = nil
 	}
 
-	if err := quicrt.Close(); err != nil {
-		return 0, err
+	if packet != nil {
+		return 0, firstErr
 	}
 
 	return len(p), nil
@@ -119,7 +140,9 @@ func Dial(ctx context.Context, pconn net.PacketConn, p2phost string, options ...
 		}
 	}
 
-	req, _, err := cfg.dial.fn(ctx, nil, nil)
+	cfg.finish()
+
+	req, _, err := cfg.dial.fns[0](ctx, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -130,17 +153,36 @@ func Dial(ctx context.Context, pconn net.PacketConn, p2phost string, options ...
 	}
 
 	conn := &dialConn{
-		ctx:   ctx,
-		pconn: pconn,
-		cfg:   cfg,
+		ctx:    ctx,
+		pconn:  pconn,
+		cfg:    cfg,
+		relays: newRelayPaths(len(cfg.dial.fns), udpAddr),
+	}
+
+	if cfg.direct.enabled {
+		conn.direct, err = newDirectPath(pconn)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	qconn, err := quic.DialContext(ctx, conn, udpAddr, p2phost, cfg.p2p.tls, cfg.p2p.qcfg)
+	qconn, err := quic.DialContext(ctx, conn, conn.relays.peerAddr(), p2phost, cfg.p2p.tls, cfg.p2p.qcfg)
 	if err != nil {
 		return nil, err
 	}
 
 	conn.quicConn = qconn
 
+	if len(cfg.dial.fns) > 1 {
+		go conn.relays.run(qconn.Context().Done(), conn.direct)
+	}
+
+	if conn.direct != nil {
+		conn.quicConn, err = conn.direct.start(qconn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return conn, err
 }
@@ -0,0 +1,410 @@
+package quicpipe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	// directProbeInterval is how often probes are sent while punching.
+	directProbeInterval = 200 * time.Millisecond
+
+	// directPunchTimeout is how long punching is attempted.
+	directPunchTimeout = 10 * time.Second
+
+	// directTimeout is how long the direct path may be silent before
+	// falling back to the relay.
+	directTimeout = 5 * time.Second
+
+	// directRetryInterval is how long to wait before punching again.
+	directRetryInterval = 30 * time.Second
+
+	// directKeepAlivePeriod is the QUIC keep-alive period used when none
+	// is configured, so that a working direct path is never silent.
+	directKeepAlivePeriod = 2 * time.Second
+
+	// directControlTimeout is how long to wait for the peer's candidates.
+	directControlTimeout = 10 * time.Second
+)
+
+const (
+	probeTypeProbe = 'p'
+	probeTypeAck   = 'a'
+
+	probeLength = 3 + 1 + 8
+)
+
+// probePrefix starts all punch probes. The first byte has the QUIC fixed bit
+// unset, so probes are never valid QUIC packets.
+var probePrefix = []byte{0x00, 'q', 'p'}
+
+func isProbe(p []byte) bool {
+	return len(p) == probeLength && bytes.HasPrefix(p, probePrefix)
+}
+
+func newProbe(typ byte, nonce []byte) []byte {
+	p := make([]byte, 0, probeLength)
+	p = append(p, probePrefix...)
+	p = append(p, typ)
+	p = append(p, nonce...)
+
+	return p
+}
+
+type reflexiveAddrKey struct{}
+
+// ReportReflexiveAddr is called by a ResponseHandler with the peer's public
+// address as observed by the relay. It is used as a candidate for the direct
+// path.
+func ReportReflexiveAddr(ctx context.Context, addr net.Addr) {
+	if fn, ok := ctx.Value(reflexiveAddrKey{}).(func(addr net.Addr)); ok {
+		fn(addr)
+	}
+}
+
+func withReflexiveAddr(ctx context.Context, d *directPath) context.Context {
+	if d == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, reflexiveAddrKey{}, d.setReflexive)
+}
+
+// directCandidates is sent over the control stream.
+type directCandidates struct {
+	Candidates []string `json:"candidates"`
+}
+
+// directPath sends packets meant for the relay directly to the peer, once
+// the peer has been reached by NAT hole punching. Packets from the peer are
+// reported as coming from the relay, so quic-go does not notice the switch.
+type directPath struct {
+	pconn net.PacketConn
+
+	nonce [8]byte
+
+	mu sync.Mutex
+
+	relayAddr net.Addr
+	reflexive *net.UDPAddr
+	remote    []*net.UDPAddr
+
+	active   *net.UDPAddr
+	lastRecv time.Time
+}
+
+func newDirectPath(pconn net.PacketConn) (*directPath, error) {
+	d := &directPath{
+		pconn: pconn,
+	}
+
+	if _, err := rand.Read(d.nonce[:]); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *directPath) setReflexive(addr net.Addr) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.reflexive = udpAddr
+}
+
+// route returns the address a packet to addr should be sent to.
+func (d *directPath) route(addr net.Addr) net.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// compared by identity, see relayPaths
+	if d.active != nil && d.relayAddr != nil && addr == d.relayAddr {
+		return d.active
+	}
+
+	return addr
+}
+
+// isCandidate reports whether addr is one of the peer's candidates. It must
+// be called with mu held.
+func (d *directPath) isCandidate(addr *net.UDPAddr) bool {
+	for _, candidate := range d.remote {
+		if candidate.String() == addr.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// receive handles a packet read from the PacketConn. It returns the address
+// to report for the packet, or false if the packet was a probe and must not
+// be passed on. Probes are only answered, and acks only accepted, from the
+// peer's candidates.
+func (d *directPath) receive(p []byte, addr net.Addr) (net.Addr, bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr, true
+	}
+
+	if isProbe(p) {
+		d.mu.Lock()
+		candidate := d.isCandidate(udpAddr)
+		d.mu.Unlock()
+
+		if !candidate {
+			return nil, false
+		}
+
+		switch p[len(probePrefix)] {
+		case probeTypeProbe:
+			d.pconn.WriteTo(newProbe(probeTypeAck, p[len(probePrefix)+1:]), udpAddr)
+
+		case probeTypeAck:
+			if bytes.Equal(p[len(probePrefix)+1:], d.nonce[:]) {
+				d.mu.Lock()
+				if d.active == nil {
+					// both directions work
+					d.active = udpAddr
+					d.lastRecv = time.Now()
+				}
+				d.mu.Unlock()
+			}
+		}
+
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.relayAddr == nil {
+		return addr, true
+	}
+
+	if d.active != nil && d.active.String() == udpAddr.String() {
+		d.lastRecv = time.Now()
+
+		return d.relayAddr, true
+	}
+
+	if d.isCandidate(udpAddr) {
+		return d.relayAddr, true
+	}
+
+	return addr, true
+}
+
+// candidates returns the addresses the peer may reach us at.
+func (d *directPath) candidates() []string {
+	var candidates []string
+
+	d.mu.Lock()
+	if d.reflexive != nil {
+		candidates = append(candidates, d.reflexive.String())
+	}
+	d.mu.Unlock()
+
+	local, ok := d.pconn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return candidates
+	}
+
+	if !local.IP.IsUnspecified() {
+		return append(candidates, local.String())
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return candidates
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if local.IP.To4() != nil && ipnet.IP.To4() == nil {
+			// IPv4 socket
+			continue
+		}
+
+		candidates = append(candidates, (&net.UDPAddr{
+			IP:   ipnet.IP,
+			Port: local.Port,
+		}).String())
+	}
+
+	return candidates
+}
+
+// start exchanges candidates with the peer over a unidirectional control
+// stream and starts punching in the background. Both peers must use the
+// direct path, as the peer's first unidirectional stream is taken as its
+// control stream. The returned connection hides that stream.
+func (d *directPath) start(qconn quic.Connection) (quic.Connection, error) {
+	d.mu.Lock()
+	d.relayAddr = qconn.RemoteAddr()
+	d.mu.Unlock()
+
+	stream, err := qconn.OpenUniStream()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &directConn{
+		Connection: qconn,
+		control:    make(chan struct{}),
+	}
+
+	ctx := qconn.Context()
+
+	go func() {
+		defer stream.Close()
+
+		json.NewEncoder(stream).Encode(directCandidates{
+			Candidates: d.candidates(),
+		})
+	}()
+
+	go func() {
+		remote := d.accept(ctx, conn)
+		if len(remote) == 0 {
+			return
+		}
+
+		d.mu.Lock()
+		d.remote = remote
+		d.mu.Unlock()
+
+		d.run(ctx)
+	}()
+
+	return conn, nil
+}
+
+// accept reads the peer's candidates from its control stream.
+func (d *directPath) accept(ctx context.Context, conn *directConn) []*net.UDPAddr {
+	defer close(conn.control)
+
+	ctx, cancel := context.WithTimeout(ctx, directControlTimeout)
+	defer cancel()
+
+	stream, err := conn.Connection.AcceptUniStream(ctx)
+	if err != nil {
+		return nil
+	}
+
+	stream.SetReadDeadline(time.Now().Add(directControlTimeout))
+
+	var message directCandidates
+	if err := json.NewDecoder(stream).Decode(&message); err != nil {
+		return nil
+	}
+
+	var remote []*net.UDPAddr
+
+	for _, candidate := range message.Candidates {
+		addr, err := net.ResolveUDPAddr("udp", candidate)
+		if err != nil {
+			continue
+		}
+
+		remote = append(remote, addr)
+	}
+
+	return remote
+}
+
+func (d *directPath) isActive() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.active != nil
+}
+
+// punch sends probes to the peer's candidates until one of them answers or
+// the punch timeout passes.
+func (d *directPath) punch(ctx context.Context) {
+	ticker := time.NewTicker(directProbeInterval)
+	defer ticker.Stop()
+
+	probe := newProbe(probeTypeProbe, d.nonce[:])
+	deadline := time.Now().Add(directPunchTimeout)
+
+	for time.Now().Before(deadline) && !d.isActive() {
+		for _, addr := range d.remote {
+			d.pconn.WriteTo(probe, addr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			// continue
+		}
+	}
+}
+
+// run punches and falls back to the relay whenever the direct path goes
+// silent, until the connection is closed.
+func (d *directPath) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastPunch := time.Now()
+	d.punch(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			d.mu.Lock()
+			if d.active != nil && now.Sub(d.lastRecv) > directTimeout {
+				// direct path stopped working
+				d.active = nil
+			}
+			active := d.active != nil
+			d.mu.Unlock()
+
+			if !active && now.Sub(lastPunch) > directRetryInterval {
+				lastPunch = now
+				d.punch(ctx)
+			}
+		}
+	}
+}
+
+// directConn hides the peer's control stream from AcceptUniStream.
+type directConn struct {
+	quic.Connection
+
+	// control is closed once the control stream was accepted
+	control chan struct{}
+}
+
+func (c *directConn) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case <-c.control:
+		return c.Connection.AcceptUniStream(ctx)
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,140 @@
+package quicpipe
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { pconn.Close() })
+
+	return pconn
+}
+
+// readProbe returns the probe read from pconn, or nil if none arrives.
+func readProbe(t *testing.T, pconn net.PacketConn) []byte {
+	t.Helper()
+
+	pconn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	buffer := make([]byte, maxPacketSize)
+
+	n, _, err := pconn.ReadFrom(buffer)
+	if err != nil {
+		return nil
+	}
+
+	return buffer[:n]
+}
+
+func newTestDirectPath(t *testing.T, candidates ...net.PacketConn) (*directPath, *net.UDPAddr) {
+	t.Helper()
+
+	d, err := newDirectPath(listenUDP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relayAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+
+	d.relayAddr = relayAddr
+
+	for _, candidate := range candidates {
+		d.remote = append(d.remote, candidate.LocalAddr().(*net.UDPAddr))
+	}
+
+	return d, relayAddr
+}
+
+func TestDirectPathProbe(t *testing.T) {
+	peer := listenUDP(t)
+	stranger := listenUDP(t)
+
+	d, _ := newTestDirectPath(t, peer)
+
+	nonce := []byte("01234567")
+
+	if _, ok := d.receive(newProbe(probeTypeProbe, nonce), stranger.LocalAddr()); ok {
+		t.Fatal("expected probe not to be passed on")
+	}
+
+	if ack := readProbe(t, stranger); ack != nil {
+		t.Fatalf("expected no ack for a probe from a non-candidate, got %x", ack)
+	}
+
+	if _, ok := d.receive(newProbe(probeTypeProbe, nonce), peer.LocalAddr()); ok {
+		t.Fatal("expected probe not to be passed on")
+	}
+
+	if ack := readProbe(t, peer); !bytes.Equal(ack, newProbe(probeTypeAck, nonce)) {
+		t.Fatalf("expected an ack for the candidate's probe, got %x", ack)
+	}
+}
+
+func TestDirectPathAck(t *testing.T) {
+	peer := listenUDP(t)
+	stranger := listenUDP(t)
+
+	d, relayAddr := newTestDirectPath(t, peer)
+
+	ack := newProbe(probeTypeAck, d.nonce[:])
+
+	d.receive(ack, stranger.LocalAddr())
+
+	if d.isActive() {
+		t.Fatal("expected an ack from a non-candidate not to activate the direct path")
+	}
+
+	if addr := d.route(relayAddr); addr != relayAddr {
+		t.Fatalf("expected packets to go to the relay, got %v", addr)
+	}
+
+	d.receive(newProbe(probeTypeAck, []byte("76543210")), peer.LocalAddr())
+
+	if d.isActive() {
+		t.Fatal("expected an ack with another nonce not to activate the direct path")
+	}
+
+	d.receive(ack, peer.LocalAddr())
+
+	if !d.isActive() {
+		t.Fatal("expected the candidate's ack to activate the direct path")
+	}
+
+	if addr := d.route(relayAddr); addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("expected packets to go to the peer, got %v", addr)
+	}
+
+	// only packets for the relay are rerouted
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+
+	if addr := d.route(other); addr != other {
+		t.Fatalf("expected packets to other addresses not to be rerouted, got %v", addr)
+	}
+}
+
+func TestDirectPathReceive(t *testing.T) {
+	peer := listenUDP(t)
+	stranger := listenUDP(t)
+
+	d, relayAddr := newTestDirectPath(t, peer)
+
+	packet := []byte{0x40, 1, 2, 3}
+
+	if addr, ok := d.receive(packet, peer.LocalAddr()); !ok || addr != relayAddr {
+		t.Fatalf("expected the candidate's packets to be reported from the relay, got %v", addr)
+	}
+
+	if addr, ok := d.receive(packet, stranger.LocalAddr()); !ok || addr != stranger.LocalAddr() {
+		t.Fatalf("expected other packets to be reported from their sender, got %v", addr)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
@@ -12,11 +11,12 @@ import (
 	"fmt"
 	"math/big"
 	"net"
-	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/hf/quicpipe"
+	"github.com/hf/quicpipe/relayhttp"
 	"github.com/lucas-clemente/quic-go"
 )
 
@@ -54,30 +54,24 @@ func createCertificate() []tls.Certificate {
 	}
 }
 
-func acceptResponse(ctx context.Context, response *http.Response) error {
-	return nil
+func exampleToken(ctx context.Context) (string, error) {
+	return os.Getenv("QUICPIPE_TOKEN"), nil
 }
 
-func acceptRequest(ctx context.Context, cid []byte) (*http.Request, func(ctx context.Context, response *http.Response) error, error) {
-	buffer := bytes.NewBuffer(make([]byte, 0, os.Getpagesize()))
-
-	if cid != nil {
-		if err := json.NewEncoder(buffer).Encode(map[string]any{
-			"key": cid,
-			"num": 10, // there will be at most 10 connection ids
-		}); err != nil {
-			return nil, nil, err
-		}
+// acceptRequests registers with each relay in the comma-separated QHOST.
+func acceptRequests() []quicpipe.CreateAcceptRequestFunc {
+	var fns []quicpipe.CreateAcceptRequestFunc
+
+	for _, host := range strings.Split(os.Getenv("QHOST"), ",") {
+		fns = append(fns, (&relayhttp.Client{
+			URL:     "https://" + host,
+			Num:     10, // there will be at most 10 connection ids
+			Token:   exampleToken,
+			Session: os.Getenv("QSESSION"),
+		}).AcceptRequest())
 	}
 
-	req, err := http.NewRequest(http.MethodPost, "https://"+os.Getenv("QHOST")+"/v1/register", buffer)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	req = req.WithContext(ctx)
-
-	return req, acceptResponse, nil
+	return fns
 }
 
 func main() {
@@ -121,7 +115,7 @@ func main() {
 			tlscfg.InsecureSkipVerify = true
 			return nil
 		}),
-		quicpipe.WithAcceptRequest(acceptRequest),
+		quicpipe.WithAcceptRequests(acceptRequests()...),
 	)
 	if err != nil {
 		panic(err)
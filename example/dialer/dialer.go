@@ -1,55 +1,54 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
-	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/hf/quicpipe"
+	"github.com/hf/quicpipe/relayhttp"
 	"github.com/lucas-clemente/quic-go"
 )
 
-func dialResponse(ctx context.Context, res *http.Response) error {
-	return nil
+func exampleToken(ctx context.Context) (string, error) {
+	return os.Getenv("QUICPIPE_TOKEN"), nil
 }
 
-func dialRequest(ctx context.Context, packet, cid []byte) (*http.Request, func(ctx context.Context, res *http.Response) error, error) {
-	buffer := bytes.NewBuffer(make([]byte, 0, os.Getpagesize()))
+func initialPacket(ctx context.Context, packet []byte) error {
+	fmt.Println("ADD THE FOLLOWING LINE TO /tmp/packet.json")
 
-	if packet != nil && cid != nil {
-		if err := json.NewEncoder(buffer).Encode(map[string]any{
-			"key": cid,
-			"num": 10, // there will be at most 10 connection ids
-		}); err != nil {
-			return nil, nil, err
-		}
+	oob, err := json.Marshal(map[string]any{
+		"packet": packet,
+	})
+	if err != nil {
+		return err
+	}
 
-		fmt.Println("ADD THE FOLLOWING LINE TO /tmp/packet.json")
+	fmt.Printf("%s\n\n", oob)
 
-		oob, err := json.Marshal(map[string]any{
-			"packet": packet,
-		})
-		if err != nil {
-			return nil, nil, err
-		}
-
-		fmt.Printf("%s\n\n", oob)
-	}
+	return nil
+}
 
-	req, err := http.NewRequest(http.MethodPost, "https://"+os.Getenv("QHOST")+"/v1/register", buffer)
-	if err != nil {
-		return nil, nil, err
+// dialRequests registers with each relay in the comma-separated QHOST.
+func dialRequests() []quicpipe.CreateDialRequestFunc {
+	var fns []quicpipe.CreateDialRequestFunc
+
+	for _, host := range strings.Split(os.Getenv("QHOST"), ",") {
+		fns = append(fns, (&relayhttp.Client{
+			URL:           "https://" + host,
+			Num:           10, // there will be at most 10 connection ids
+			Token:         exampleToken,
+			Session:       os.Getenv("QSESSION"),
+			InitialPacket: initialPacket,
+		}).DialRequest())
 	}
 
-	req = req.WithContext(ctx)
-
-	return req, dialResponse, nil
+	return fns
 }
 
 func main() {
@@ -79,7 +78,7 @@ func main() {
 			tlscfg.InsecureSkipVerify = true
 			return nil
 		}),
-		quicpipe.WithDialRequest(dialRequest),
+		quicpipe.WithDialRequests(dialRequests()...),
 	)
 
 	if err != nil {
@@ -6,18 +6,19 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"fmt"
 	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/cilium/ebpf/rlimit"
-	"github.com/go-chi/chi"
 	"github.com/hf/quicpipe"
+	"github.com/hf/quicpipe/metrics"
+	"github.com/hf/quicpipe/token"
 	"github.com/hf/quicpipe/xdp"
 	"github.com/lucas-clemente/quic-go/http3"
 )
@@ -56,15 +57,72 @@ func createCertificate() []tls.Certificate {
 	}
 }
 
+const (
+	// packets per second and burst accepted from each source address
+	sourceRate  = 10000
+	sourceBurst = 1000
+)
+
+// xdpMetrics adds the XDP filter's counters to the registry.
+func xdpMetrics(registry *metrics.Registry, xdplink *xdp.XDPLink) {
+	stat := func(fn func(stats xdp.Stats) uint64) func() float64 {
+		return func() float64 {
+			stats, err := xdplink.Stats()
+			if err != nil {
+				return 0
+			}
+
+			return float64(fn(stats))
+		}
+	}
+
+	registry.CounterFunc("quicpipe_xdp_packets_redirected_total", "Packets redirected by the XDP filter.", stat(func(stats xdp.Stats) uint64 { return stats.Redirected }))
+	registry.CounterFunc("quicpipe_xdp_bytes_redirected_total", "Bytes redirected by the XDP filter.", stat(func(stats xdp.Stats) uint64 { return stats.RedirectedBytes }))
+	registry.CounterFunc("quicpipe_xdp_packets_passed_total", "Packets passed to the network stack by the XDP filter.", stat(func(stats xdp.Stats) uint64 { return stats.Passed }))
+	registry.CounterFunc("quicpipe_xdp_packets_dropped_total", "Packets dropped by the XDP filter.", stat(func(stats xdp.Stats) uint64 { return stats.Dropped }))
+	registry.CounterFunc("quicpipe_xdp_packets_rejected_total", "Packets rejected by the XDP filter for an unknown connection ID.", stat(func(stats xdp.Stats) uint64 { return stats.Rejected }))
+	registry.CounterFunc("quicpipe_xdp_packets_limited_total", "Packets dropped by the XDP filter's source rate limit.", stat(func(stats xdp.Stats) uint64 { return stats.Limited }))
+	registry.CounterFunc("quicpipe_xdp_packets_spoofed_total", "Packets dropped by the XDP filter's source verification.", stat(func(stats xdp.Stats) uint64 { return stats.Spoofed }))
+}
+
 func main() {
-	udpconn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	secret := os.Getenv("QUICPIPE_TOKEN_SECRET")
+	if secret == "" {
+		fmt.Fprintln(os.Stderr, "QUICPIPE_TOKEN_SECRET is not set")
+		os.Exit(1)
+	}
+
+	workers := 1
+
+	if value := os.Getenv("QUICPIPE_WORKERS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			panic(err)
+		}
+
+		workers = n
+	}
+
+	udpconns, err := quicpipe.ListenReusePort(context.Background(), "udp4", ":0", workers)
 	if err != nil {
 		panic(err)
 	}
 
+	udpconn := udpconns[0]
+
 	fmt.Printf("addr: %s\n", udpconn.LocalAddr().String())
 
+	registry := metrics.New()
+
 	mapstore := quicpipe.NewMapStore()
+	mapstore.Metrics = registry
+
+	accounting := quicpipe.NewAccounting()
+	accounting.OnQuotaExceeded = func(association quicpipe.Association, usage quicpipe.Usage) {
+		fmt.Printf("association %x exceeded its quota with %d bytes\n", association.ConnectionIDs[0], usage.Bytes)
+	}
+
+	verifySource := os.Getenv("QUICPIPE_VERIFY_SOURCE") != ""
 
 	if runtime.GOOS == "linux" {
 		ifaceName := os.Getenv("QUICPIPE_XDP_IFACE")
@@ -79,7 +137,13 @@ func main() {
 				panic(err)
 			}
 
-			xdplink, err := xdp.Open()
+			var xdplink *xdp.XDPLink
+
+			if pinPath := os.Getenv("QUICPIPE_XDP_PIN"); pinPath != "" {
+				xdplink, err = xdp.OpenPinned(pinPath, nil)
+			} else {
+				xdplink, err = xdp.Open(nil)
+			}
 			if err != nil {
 				panic(err)
 			}
@@ -100,53 +164,82 @@ func main() {
 				panic(err)
 			}
 
+			if err := xdplink.SetSourceRateLimit(sourceRate, sourceBurst); err != nil {
+				panic(err)
+			}
+
+			if err := xdplink.SetSourceVerification(verifySource); err != nil {
+				panic(err)
+			}
+
 			mapstore.XDP = xdplink
-		}
-	}
 
-	conn := quicpipe.NewServerConnection(
-		context.Background(),
-		udpconn,
-		mapstore,
-	)
+			repopulator := &quicpipe.Repopulator{
+				XDP:        xdplink,
+				Store:      mapstore,
+				Rate:       1000,
+				Burst:      100,
+				Accounting: accounting,
+			}
 
-	router := chi.NewRouter()
-	router.Post("/v1/register", func(w http.ResponseWriter, r *http.Request) {
-		var registerReq struct {
-			Key []byte `json:"key"`
-			Num int    `json:"num"`
+			go repopulator.Run(context.Background())
+
+			go func() {
+				for range time.Tick(10 * time.Second) {
+					if err := accounting.Harvest(context.Background(), mapstore, xdplink); err != nil {
+						fmt.Printf("unable to harvest XDP usage: %v\n", err)
+					}
+				}
+			}()
+
+			xdpMetrics(registry, xdplink)
+			registry.CounterFunc("quicpipe_repopulator_hits_total", "Rejected CIDs whose redirects were re-inserted.", func() float64 {
+				return float64(repopulator.Stats().Hits)
+			})
+			registry.CounterFunc("quicpipe_repopulator_misses_total", "Rejected CIDs without an association.", func() float64 {
+				return float64(repopulator.Stats().Misses)
+			})
 		}
+	}
 
-		dec := json.NewDecoder(r.Body)
-		defer r.Body.Close()
+	go mapstore.Sweep(context.Background(), time.Minute, func(err error) {
+		fmt.Printf("unable to expire associations: %v\n", err)
+	})
 
-		err := dec.Decode(&registerReq)
-		if err != nil {
-			w.WriteHeader(400)
-			return
-		}
+	options := []quicpipe.Option{
+		quicpipe.WithMetrics(registry),
+		quicpipe.WithAccounting(accounting),
+		quicpipe.WithSourceRateLimit(sourceRate, sourceBurst),
+	}
 
-		addr, err := net.ResolveUDPAddr("udp", r.RemoteAddr)
-		if err != nil {
-			panic(err)
-		}
+	if verifySource {
+		options = append(options, quicpipe.WithSourceVerification())
+	}
 
-		fmt.Printf("registering %v connection IDs for %v\n", registerReq.Num, addr.String())
+	var conn quicpipe.ServerConnection
 
-		err = conn.Register(r.Context(), registerReq.Key, registerReq.Num, addr)
-		if err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte("bad"))
-			return
-		}
+	if workers > 1 {
+		conn, err = quicpipe.NewWorkerServerConnection(context.Background(), udpconns, mapstore, options...)
+	} else if os.Getenv("QUICPIPE_BATCH") != "" {
+		conn, err = quicpipe.NewBatchServerConnection(context.Background(), udpconn, mapstore, options...)
+	} else {
+		conn, err = quicpipe.NewServerConnectionWithOptions(context.Background(), udpconn, mapstore, options...)
+	}
+	if err != nil {
+		panic(err)
+	}
 
-		w.WriteHeader(200)
-		w.Write([]byte("OK"))
-	})
+	if addr := os.Getenv("QUICPIPE_METRICS_ADDR"); addr != "" {
+		go func() {
+			if err := http.ListenAndServe(addr, registry); err != nil {
+				fmt.Printf("unable to serve metrics: %v\n", err)
+			}
+		}()
+	}
 
 	server := http3.Server{
 		QuicConfig: quicpipe.StandardQUICConfig(nil, true),
-		Handler:    router,
+		Handler:    token.NewHandler(conn, []byte(secret)),
 		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
 			Certificates: createCertificate(),
 		}),
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hf/quicpipe/token"
+)
+
+func main() {
+	peer := flag.String("peer", "", "peer identity, owns the connection IDs it registers")
+	key := flag.String("key", "", "hex connection ID key the peer may register, any if empty")
+	num := flag.Int("num", 10, "maximum number of connection IDs")
+	session := flag.String("session", "", "session the peer may join, any if empty")
+	ttl := flag.Duration("ttl", time.Hour, "token lifetime")
+	flag.Parse()
+
+	if *peer == "" {
+		fmt.Fprintln(os.Stderr, "-peer is required")
+		os.Exit(1)
+	}
+
+	keyBytes, err := hex.DecodeString(*key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-key is not hex: %v\n", err)
+		os.Exit(1)
+	}
+
+	secret := os.Getenv("QUICPIPE_TOKEN_SECRET")
+	if secret == "" {
+		fmt.Fprintln(os.Stderr, "QUICPIPE_TOKEN_SECRET is not set")
+		os.Exit(1)
+	}
+
+	t, err := token.Sign([]byte(secret), token.Claims{
+		Peer:             *peer,
+		Key:              keyBytes,
+		Session:          *session,
+		MaxConnectionIDs: *num,
+		ExpiresAt:        time.Now().Add(*ttl),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(t)
+}
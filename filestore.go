@@ -0,0 +1,363 @@
+package quicpipe
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// fileStoreCompactRecords is the minimum number of records in the log
+	// before it is compacted.
+	fileStoreCompactRecords = 1024
+)
+
+const (
+	fileStoreOpPut           = "put"
+	fileStoreOpDelete        = "delete"
+	fileStoreOpDeleteSession = "delete_session"
+)
+
+type fileStoreAssociation struct {
+	ConnectionIDs [][]byte `json:"cids"`
+	Addr          string   `json:"addr"`
+	TTL           int64    `json:"ttl,omitempty"`
+	Session       string   `json:"session,omitempty"`
+	Owner         string   `json:"owner,omitempty"`
+
+	MaxBytes uint64  `json:"max_bytes,omitempty"`
+	Rate     float64 `json:"rate,omitempty"`
+	Burst    int     `json:"burst,omitempty"`
+}
+
+// fileStoreRecord is a line of the log.
+type fileStoreRecord struct {
+	Op          string                `json:"op"`
+	Association *fileStoreAssociation `json:"association,omitempty"`
+	CID         []byte                `json:"cid,omitempty"`
+	Session     string                `json:"session,omitempty"`
+}
+
+func toFileStoreAssociation(association Association) *fileStoreAssociation {
+	var addr string
+	if association.Addr != nil {
+		addr = association.Addr.String()
+	}
+
+	return &fileStoreAssociation{
+		ConnectionIDs: association.ConnectionIDs,
+		Addr:          addr,
+		TTL:           int64(association.TTL),
+		Session:       association.Session,
+		Owner:         association.Owner,
+		MaxBytes:      association.Quota.MaxBytes,
+		Rate:          association.Quota.Rate,
+		Burst:         association.Quota.Burst,
+	}
+}
+
+func (a *fileStoreAssociation) association() (Association, error) {
+	association := Association{
+		ConnectionIDs: a.ConnectionIDs,
+		TTL:           time.Duration(a.TTL),
+		Session:       a.Session,
+		Owner:         a.Owner,
+		Quota: Quota{
+			MaxBytes: a.MaxBytes,
+			Rate:     a.Rate,
+			Burst:    a.Burst,
+		},
+	}
+
+	if a.Addr != "" {
+		addr, err := net.ResolveUDPAddr("udp", a.Addr)
+		if err != nil {
+			return Association{}, err
+		}
+
+		association.Addr = addr
+	}
+
+	return association, nil
+}
+
+// FileStore is a MapStore which survives restarts. Changes are appended to a
+// log file, which is replayed into memory when opened and compacted once it
+// is mostly made of stale records. Addresses are stored as UDP addresses.
+//
+// Associations removed by Expire are not logged, so they are restored when
+// the log is replayed and expire again after their TTL, unless the log has
+// been compacted in the meantime.
+type FileStore struct {
+	*MapStore
+
+	// Sync, if set, flushes the log to disk after every change.
+	Sync bool
+
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	records int
+}
+
+// OpenFileStore replays the log at path, creating it if it does not exist,
+// and compacts it. The redirects of all replayed associations are added to
+// xdp, which may be nil, so that the XDP filter forwards packets of in-flight
+// sessions right after a restart.
+func OpenFileStore(path string, xdp XDPRedirector) (*FileStore, error) {
+	f := &FileStore{
+		MapStore: NewMapStore(),
+		path:     path,
+	}
+
+	if err := f.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := f.Compact(); err != nil {
+		return nil, err
+	}
+
+	f.XDP = xdp
+
+	for _, association := range f.owned() {
+		if err := addRedirects(xdp, association); err != nil {
+			f.Close()
+
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (f *FileStore) replay() error {
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	dec := json.NewDecoder(bufio.NewReader(file))
+
+	for {
+		var record fileStoreRecord
+
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// a torn last record is dropped by compaction
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := f.apply(ctx, record); err != nil && !errors.Is(err, ErrAssociationNotFound) {
+			return err
+		}
+	}
+}
+
+func (f *FileStore) apply(ctx context.Context, record fileStoreRecord) error {
+	switch record.Op {
+	case fileStoreOpPut:
+		if record.Association == nil {
+			return nil
+		}
+
+		association, err := record.Association.association()
+		if err != nil {
+			return err
+		}
+
+		return f.MapStore.PutAssociation(ctx, association)
+
+	case fileStoreOpDelete:
+		return f.MapStore.DeleteAssociation(ctx, record.CID)
+
+	case fileStoreOpDeleteSession:
+		return f.MapStore.DeleteSession(ctx, record.Session)
+	}
+
+	return nil
+}
+
+// log appends a record. Must be called with the lock held.
+func (f *FileStore) log(record fileStoreRecord) error {
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	f.records += 1
+
+	if f.Sync {
+		return f.file.Sync()
+	}
+
+	return nil
+}
+
+// change logs and applies a record, compacting the log when it has grown.
+func (f *FileStore) change(ctx context.Context, record fileStoreRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.changeLocked(ctx, record)
+}
+
+// changeLocked is change with the lock held.
+func (f *FileStore) changeLocked(ctx context.Context, record fileStoreRecord) error {
+	if err := f.log(record); err != nil {
+		return err
+	}
+
+	if err := f.apply(ctx, record); err != nil {
+		return err
+	}
+
+	if f.records >= fileStoreCompactRecords && f.records > 2*f.Len() {
+		return f.compact()
+	}
+
+	return nil
+}
+
+func (f *FileStore) PutAssociation(ctx context.Context, association Association) error {
+	return f.change(ctx, fileStoreRecord{
+		Op:          fileStoreOpPut,
+		Association: toFileStoreAssociation(association),
+	})
+}
+
+// PutAssociationIf is like MapStore.PutAssociationIf, and logs the
+// association if it is put.
+func (f *FileStore) PutAssociationIf(ctx context.Context, association Association, check func(replaced []Association) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if check != nil {
+		f.MapStore.Lock()
+		replaced := f.MapStore.replaced(association.ConnectionIDs)
+		f.MapStore.Unlock()
+
+		// changes are logged with the lock held, so nothing else is put
+		// in the meantime
+		if err := check(replaced); err != nil {
+			return err
+		}
+	}
+
+	return f.changeLocked(ctx, fileStoreRecord{
+		Op:          fileStoreOpPut,
+		Association: toFileStoreAssociation(association),
+	})
+}
+
+func (f *FileStore) DeleteAssociation(ctx context.Context, cid []byte) error {
+	return f.change(ctx, fileStoreRecord{
+		Op:  fileStoreOpDelete,
+		CID: cid,
+	})
+}
+
+func (f *FileStore) DeleteSession(ctx context.Context, session string) error {
+	return f.change(ctx, fileStoreRecord{
+		Op:      fileStoreOpDeleteSession,
+		Session: session,
+	})
+}
+
+// Compact rewrites the log with only the current associations, each with the
+// CIDs it still holds.
+func (f *FileStore) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.compact()
+}
+
+// compact must be called with the lock held.
+func (f *FileStore) compact() error {
+	tmp := f.path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	associations := f.owned()
+
+	err = func() error {
+		defer file.Close()
+
+		w := bufio.NewWriter(file)
+		enc := json.NewEncoder(w)
+
+		for _, association := range associations {
+			err := enc.Encode(fileStoreRecord{
+				Op:          fileStoreOpPut,
+				Association: toFileStoreAssociation(association),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		return file.Sync()
+	}()
+	if err != nil {
+		os.Remove(tmp)
+
+		return err
+	}
+
+	if err := os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+
+	f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	f.records = len(associations)
+
+	return nil
+}
+
+// Close closes the log. The associations remain readable, but changes fail.
+func (f *FileStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	return f.file.Close()
+}
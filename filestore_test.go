@@ -0,0 +1,156 @@
+package quicpipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestFileStore(t *testing.T, path string, xdp XDPRedirector) *FileStore {
+	t.Helper()
+
+	f, err := OpenFileStore(path, xdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { f.Close() })
+
+	return f
+}
+
+func TestFileStoreTakeover(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.log")
+
+	f := openTestFileStore(t, path, nil)
+
+	const n = 16
+
+	oldAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	newAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2}
+
+	// the second CID of each association is taken over by a later put
+	for i := byte(0); i < n; i += 1 {
+		old := Association{ConnectionIDs: [][]byte{{i, 0}, {i, 1}}, Addr: oldAddr}
+		if err := f.PutAssociation(ctx, old); err != nil {
+			t.Fatal(err)
+		}
+
+		taken := Association{ConnectionIDs: [][]byte{{i, 1}}, Addr: newAddr}
+		if err := f.PutAssociation(ctx, taken); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	xdp := newFakeXDP()
+	f = openTestFileStore(t, path, xdp)
+
+	if f.Len() != 2*n {
+		t.Fatalf("expected %d associations, got %d", 2*n, f.Len())
+	}
+
+	for i := byte(0); i < n; i += 1 {
+		old, err := f.GetAssociation(ctx, []byte{i, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(old.ConnectionIDs) != 1 || !bytes.Equal(old.ConnectionIDs[0], []byte{i, 0}) || old.Addr.String() != oldAddr.String() {
+			t.Fatalf("expected the old association with only the CID it holds, got %v at %v", old.ConnectionIDs, old.Addr)
+		}
+
+		taken, err := f.GetAssociation(ctx, []byte{i, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if taken.Addr.String() != newAddr.String() {
+			t.Fatalf("expected the taken over CID at %v, got %v", newAddr, taken.Addr)
+		}
+	}
+
+	for i := byte(0); i < n; i += 1 {
+		if addr := xdp.redirects[hex.EncodeToString([]byte{i, 1})]; addr == nil || addr.String() != newAddr.String() {
+			t.Fatalf("expected the taken over CID to be redirected to %v, got %v", newAddr, addr)
+		}
+
+		if addr := xdp.redirects[hex.EncodeToString([]byte{i, 0})]; addr == nil || addr.String() != oldAddr.String() {
+			t.Fatalf("expected the old CID to be redirected to %v, got %v", oldAddr, addr)
+		}
+	}
+}
+
+func TestFileStoreExpireReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.log")
+
+	f := openTestFileStore(t, path, nil)
+
+	association := Association{
+		ConnectionIDs: [][]byte{{1}},
+		Addr:          &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1},
+		TTL:           time.Minute,
+	}
+
+	if err := f.PutAssociation(ctx, association); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Expire(ctx, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.GetAssociation(ctx, []byte{1}); !errors.Is(err, ErrAssociationNotFound) {
+		t.Fatalf("expected the association to expire, got %v", err)
+	}
+
+	f.Close()
+
+	// expiry is not logged, so the association is restored with a fresh TTL
+	f = openTestFileStore(t, path, nil)
+
+	if _, err := f.GetAssociation(ctx, []byte{1}); err != nil {
+		t.Fatalf("expected the association to be restored, got %v", err)
+	}
+
+	if err := f.Expire(ctx, time.Now().Add(30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Len() != 1 {
+		t.Fatal("expected the restored association to be kept for its TTL")
+	}
+
+	if err := f.Expire(ctx, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Len() != 0 {
+		t.Fatal("expected the restored association to expire again")
+	}
+
+	// compacting after expiry drops it from the log
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	f = openTestFileStore(t, path, nil)
+
+	if f.Len() != 0 {
+		t.Fatalf("expected no associations after compaction, got %d", f.Len())
+	}
+}
@@ -3,13 +3,14 @@ module github.com/hf/quicpipe
 go 1.19
 
 require (
-	github.com/go-chi/chi v1.5.4
+	github.com/cilium/ebpf v0.9.3
 	github.com/hf/quicpacket v0.0.0-20221002115033-9a4946ed82ca
 	github.com/lucas-clemente/quic-go v0.31.1
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b
+	golang.org/x/sys v0.1.1-0.20221102194838-fc697a31fa06
 )
 
 require (
-	github.com/cilium/ebpf v0.9.3 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20210107165309-348f09dbbbc0 // indirect
 	github.com/golang/mock v1.6.0 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
@@ -20,8 +21,6 @@ require (
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
 	golang.org/x/exp v0.0.0-20220722155223-a9213eeb770e // indirect
 	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
-	golang.org/x/net v0.0.0-20220722155237-a158d28d115b // indirect
-	golang.org/x/sys v0.1.1-0.20221102194838-fc697a31fa06 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/tools v0.1.12 // indirect
 )
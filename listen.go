@@ -2,36 +2,103 @@ package quicpipe
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
 	"os"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/http3"
 )
 
 type acceptConn struct {
 	ctx context.Context
 
-	pconn net.PacketConn
-
-	oobPackets chan []byte
-	remoteAddr net.Addr
+	pconn  net.PacketConn
+	relays *relayPaths
+	direct *directPath
 
 	quicConn      quic.Connection
 	quicEarlyConn quic.EarlyConnection
 
-	readDeadline atomic.Value
+	// mu guards the out-of-band packets and the read deadline. While
+	// out-of-band packets are pending, the PacketConn's read deadline is in
+	// the past, which wakes up a blocked ReadFrom.
+	mu           sync.Mutex
+	oobPackets   []oobPacket
+	readDeadline time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// oobPacket is a packet delivered out-of-band, read is closed once ReadFrom
+// has returned it.
+type oobPacket struct {
+	packet []byte
+	read   chan struct{}
+}
+
+func newAcceptConn(ctx context.Context, pconn net.PacketConn, relays *relayPaths) *acceptConn {
+	return &acceptConn{
+		ctx:    ctx,
+		pconn:  pconn,
+		relays: relays,
+		closed: make(chan struct{}),
+	}
+}
+
+// maxPacketSize is the largest UDP payload read from the PacketConn, the same
+// as the size of quic-go's receive buffers.
+const maxPacketSize = 1452
+
+// aLongTimeAgo is a read deadline in the past, it wakes up a blocked read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// inject queues an out-of-band packet for ReadFrom and waits until it is
+// read.
+func (c *acceptConn) inject(packet []byte) error {
+	oob := oobPacket{packet: packet, read: make(chan struct{})}
+
+	select {
+	case <-c.closed:
+		return ErrListenerClosed
+
+	default:
+		// continue
+	}
+
+	c.mu.Lock()
+	c.oobPackets = append(c.oobPackets, oob)
+	err := c.pconn.SetReadDeadline(aLongTimeAgo)
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-oob.read:
+		return nil
+
+	case <-c.closed:
+		return ErrListenerClosed
+	}
 }
 
 func (c *acceptConn) SetReadDeadline(t time.Time) error {
-	c.readDeadline.Store(t)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return nil
+	c.readDeadline = t
+
+	if len(c.oobPackets) > 0 {
+		// keep waking up the reader for the pending packets
+		return nil
+	}
+
+	return c.pconn.SetReadDeadline(t)
 }
 
 func (c *acceptConn) SetWriteDeadline(t time.Time) error {
@@ -39,12 +106,18 @@ func (c *acceptConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (c *acceptConn) SetDeadline(t time.Time) error {
-	c.readDeadline.Store(t)
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
 
 	return c.pconn.SetWriteDeadline(t)
 }
 
 func (c *acceptConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
 	return c.pconn.Close()
 }
 
@@ -52,45 +125,90 @@ func (c *acceptConn) LocalAddr() net.Addr {
 	return c.pconn.LocalAddr()
 }
 
-func (c *acceptConn) ReadFrom(p []byte) (int, net.Addr, error) {
-	for {
-		select {
-		case oob := <-c.oobPackets:
-			n := copy(p, oob)
-			return n, c.remoteAddr, nil
+// next returns the next out-of-band packet, or an error if the read deadline
+// has passed or the connection is closed.
+func (c *acceptConn) next() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+
+	default:
+		// continue
+	}
 
-		default:
-			// continue
+	if len(c.oobPackets) > 0 {
+		oob := c.oobPackets[0]
+		c.oobPackets[0] = oobPacket{}
+		c.oobPackets = c.oobPackets[1:]
+
+		close(oob.read)
+
+		if len(c.oobPackets) == 0 {
+			c.oobPackets = nil
+
+			if err := c.pconn.SetReadDeadline(c.readDeadline); err != nil {
+				return nil, err
+			}
 		}
 
-		if err := c.pconn.SetReadDeadline(time.Now().Add(5 * time.Millisecond)); err != nil {
+		return oob.packet, nil
+	}
+
+	if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+		return nil, os.ErrDeadlineExceeded
+	}
+
+	return nil, nil
+}
+
+// ReadFrom reads directly from the PacketConn into p. Out-of-band packets and
+// changes of the read deadline wake it up through the PacketConn's read
+// deadline.
+func (c *acceptConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		oob, err := c.next()
+		if err != nil {
 			return 0, nil, err
 		}
 
+		if oob != nil {
+			n := copy(p, oob)
+			return n, c.relays.peerAddr(), nil
+		}
+
 		n, addr, err := c.pconn.ReadFrom(p)
 		if err != nil {
-			if !errors.Is(err, os.ErrDeadlineExceeded) {
-				return n, addr, err
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// woken up for an out-of-band packet, or the deadline passed
+				continue
 			}
-		} else {
-			// successfully read packets don't trigger deadline
-			// exceeded
+
 			return n, addr, err
 		}
 
-		rd := c.readDeadline.Load()
-		if rd != nil {
-			rdt := rd.(time.Time)
+		c.relays.receive(addr)
 
-			if time.Now().After(rdt) {
-				return 0, nil, os.ErrDeadlineExceeded
-			}
+		if c.direct == nil {
+			return n, addr, nil
+		}
+
+		if addr, ok := c.direct.receive(p[:n], addr); ok {
+			return n, addr, nil
 		}
+
+		// probes are not passed on
 	}
 }
 
 func (c *acceptConn) WriteTo(p []byte, addr net.Addr) (int, error) {
-	return c.pconn.WriteTo(p, addr)
+	if c.direct != nil {
+		addr = c.direct.route(addr)
+	}
+
+	return c.pconn.WriteTo(p, c.relays.route(addr))
 }
 
 func (c *acceptConn) Connection() quic.Connection {
@@ -99,6 +217,8 @@ func (c *acceptConn) Connection() quic.Connection {
 
 type CreateRequestFunc = func(ctx context.Context, cid []byte, num int) (*http.Request, error)
 
+// Accept accepts a single dialer, whose initial packet was delivered
+// out-of-band. Use Listen to accept many dialers on one PacketConn.
 func Accept(ctx context.Context, pconn net.PacketConn, packet []byte, options ...Option) (Connection, error) {
 	cfg := &config{}
 
@@ -108,71 +228,30 @@ func Accept(ctx context.Context, pconn net.PacketConn, packet []byte, options ..
 		}
 	}
 
-	conn := &acceptConn{
-		ctx:        ctx,
-		pconn:      pconn,
-		oobPackets: make(chan []byte),
-	}
-
-	quicrt := &http3.RoundTripper{
-		QuicConfig: cfg.relay.qcfg,
-		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, qcfg *quic.Config) (quic.EarlyConnection, error) {
-			udpAddr, err := net.ResolveUDPAddr("udp", addr)
-			if err != nil {
-				return nil, err
-			}
-
-			conn.remoteAddr = udpAddr
-
-			if cfg.relay.tls != nil {
-				if err := cfg.relay.tls(ctx, tlsCfg); err != nil {
-					return nil, err
-				}
-			}
+	cfg.finish()
 
-			return quic.DialEarlyContext(ctx, conn, udpAddr, addr, tlsCfg, qcfg)
-		},
-	}
-
-	quicclient := &http.Client{
-		Transport: quicrt,
-	}
-
-	req, resh, err := cfg.accept.fn(ctx, cfg.p2p.qcfg.ConnectionIDGenerator.(*ConnectionIDGenerator).Key)
-	if err != nil {
-		return nil, err
-	}
-
-	res, err := quicclient.Do(req)
+	ln, err := listen(ctx, pconn, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := resh(ctx, res); err != nil {
-		quicrt.Close()
-
-		return nil, err
-	}
-
-	if err := quicrt.Close(); err != nil {
+	if err := ln.Inject(packet); err != nil {
 		return nil, err
 	}
 
-	go func() {
-		conn.oobPackets <- packet
-	}()
-
-	qln, err := quic.Listen(conn, cfg.p2p.tls, cfg.p2p.qcfg)
+	qconn, err := ln.qln.Accept(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	qconn, err := qln.Accept(ctx)
-	if err != nil {
-		return nil, err
-	}
+	ln.conn.quicConn = qconn
 
-	conn.quicConn = qconn
+	if ln.conn.direct != nil {
+		ln.conn.quicConn, err = ln.conn.direct.start(qconn)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return conn, err
+	return ln.conn, err
 }
@@ -0,0 +1,339 @@
+package quicpipe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pollingConn reads like acceptConn.ReadFrom did before it waited for
+// packets: it polls the PacketConn with a 5ms read deadline to check for
+// out-of-band packets and its own read deadline.
+type pollingConn struct {
+	pconn net.PacketConn
+
+	oobPackets chan []byte
+	remoteAddr net.Addr
+
+	readDeadline atomic.Value
+}
+
+func (c *pollingConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+
+	return nil
+}
+
+func (c *pollingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case oob := <-c.oobPackets:
+			n := copy(p, oob)
+			return n, c.remoteAddr, nil
+
+		default:
+			// continue
+		}
+
+		if err := c.pconn.SetReadDeadline(time.Now().Add(5 * time.Millisecond)); err != nil {
+			return 0, nil, err
+		}
+
+		n, addr, err := c.pconn.ReadFrom(p)
+		if err == nil {
+			return n, addr, nil
+		}
+
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, addr, err
+		}
+
+		if rd, ok := c.readDeadline.Load().(time.Time); ok && time.Now().After(rd) {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// countingConn counts the reads from the PacketConn, each of which wakes up
+// the reader.
+type countingConn struct {
+	net.PacketConn
+
+	reads int64
+}
+
+func (c *countingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	atomic.AddInt64(&c.reads, 1)
+
+	return c.PacketConn.ReadFrom(p)
+}
+
+type benchmarkConn interface {
+	ReadFrom(p []byte) (int, net.Addr, error)
+	SetReadDeadline(t time.Time) error
+}
+
+// benchmarkReaders runs fn with the polling and the waiting reader, each on
+// its own UDP socket.
+func benchmarkReaders(b *testing.B, fn func(b *testing.B, conn benchmarkConn, pconn *countingConn, inject func(packet []byte) error)) {
+	listen := func(b *testing.B) *countingConn {
+		pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Cleanup(func() { pconn.Close() })
+
+		return &countingConn{PacketConn: pconn}
+	}
+
+	b.Run("polling", func(b *testing.B) {
+		pconn := listen(b)
+
+		conn := &pollingConn{
+			pconn:      pconn,
+			oobPackets: make(chan []byte),
+			remoteAddr: pconn.LocalAddr(),
+		}
+
+		fn(b, conn, pconn, func(packet []byte) error {
+			conn.oobPackets <- packet
+			return nil
+		})
+	})
+
+	b.Run("waiting", func(b *testing.B) {
+		pconn := listen(b)
+
+		conn := newAcceptConn(context.Background(), pconn, newRelayPaths(0, nil))
+		b.Cleanup(func() { conn.Close() })
+
+		fn(b, conn, pconn, conn.inject)
+	})
+}
+
+// BenchmarkReadFromPacket measures the latency of packets from the
+// PacketConn.
+func BenchmarkReadFromPacket(b *testing.B) {
+	benchmarkReaders(b, func(b *testing.B, conn benchmarkConn, pconn *countingConn, inject func(packet []byte) error) {
+		sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer sender.Close()
+
+		packet := make([]byte, 1200)
+		buffer := make([]byte, maxPacketSize)
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i += 1 {
+			if _, err := sender.WriteTo(packet, pconn.LocalAddr()); err != nil {
+				b.Fatal(err)
+			}
+
+			if _, _, err := conn.ReadFrom(buffer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkReadFromOutOfBand measures the latency of out-of-band packets,
+// such as the dialer's initial packet.
+func BenchmarkReadFromOutOfBand(b *testing.B) {
+	benchmarkReaders(b, func(b *testing.B, conn benchmarkConn, pconn *countingConn, inject func(packet []byte) error) {
+		packet := make([]byte, 1200)
+		buffer := make([]byte, maxPacketSize)
+
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+
+				default:
+					if err := inject(packet); err != nil {
+						return
+					}
+				}
+			}
+		}()
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i += 1 {
+			if _, _, err := conn.ReadFrom(buffer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAcceptConnReadDeadline(t *testing.T) {
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newAcceptConn(context.Background(), pconn, newRelayPaths(0, nil))
+	defer conn.Close()
+
+	buffer := make([]byte, maxPacketSize)
+
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+
+	if _, _, err := conn.ReadFrom(buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected passed deadline to be exceeded, got %v", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	done := make(chan error)
+
+	go func() {
+		_, _, err := conn.ReadFrom(buffer)
+		done <- err
+	}()
+
+	// a deadline set while reading wakes up the reader
+	time.Sleep(10 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline to be exceeded, got %v", err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("deadline set while reading did not wake up the reader")
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	conn.Close()
+
+	if _, _, err := conn.ReadFrom(buffer); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed connection, got %v", err)
+	}
+}
+
+func TestAcceptConnIdle(t *testing.T) {
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counting := &countingConn{PacketConn: pconn}
+
+	conn := newAcceptConn(context.Background(), counting, newRelayPaths(0, nil))
+	defer conn.Close()
+
+	buffer := make([]byte, maxPacketSize)
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	if _, _, err := conn.ReadFrom(buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+
+	// the polling reader would have woken up 10 times
+	if reads := atomic.LoadInt64(&counting.reads); reads != 1 {
+		t.Fatalf("expected an idle reader to read once, read %d times", reads)
+	}
+}
+
+func TestAcceptConnInject(t *testing.T) {
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newAcceptConn(context.Background(), pconn, newRelayPaths(0, nil))
+	defer conn.Close()
+
+	injected := make(chan error)
+
+	go func() {
+		injected <- conn.inject([]byte("initial"))
+	}()
+
+	select {
+	case err := <-injected:
+		t.Fatalf("inject returned before the packet was read: %v", err)
+
+	case <-time.After(10 * time.Millisecond):
+		// still waiting for the reader
+	}
+
+	buffer := make([]byte, maxPacketSize)
+
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buffer[:n]) != "initial" {
+		t.Fatalf("expected the injected packet, got %q", buffer[:n])
+	}
+
+	if err := <-injected; err != nil {
+		t.Fatal(err)
+	}
+
+	// a packet injected while reading wakes up the reader
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		injected <- conn.inject([]byte("woken"))
+	}()
+
+	n, _, err = conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buffer[:n]) != "woken" {
+		t.Fatalf("expected the injected packet, got %q", buffer[:n])
+	}
+
+	if err := <-injected; err != nil {
+		t.Fatal(err)
+	}
+
+	// afterwards packets are read from the PacketConn again
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sender.Close()
+
+	if _, err := sender.WriteTo([]byte("packet"), pconn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	n, addr, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buffer[:n]) != "packet" || addr.String() != sender.LocalAddr().String() {
+		t.Fatalf("expected the sent packet, got %q from %v", buffer[:n], addr)
+	}
+
+	conn.Close()
+
+	if err := conn.inject([]byte("closed")); !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("expected closed listener, got %v", err)
+	}
+}
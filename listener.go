@@ -0,0 +1,374 @@
+package quicpipe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+var (
+	ErrListenerClosed     = errors.New("quicpipe: listener is closed")
+	ErrListenerDirectPath = errors.New("quicpipe: listener does not support direct paths")
+
+	// ErrConnectionIDsExhausted is returned when all connection IDs of the
+	// current key have been issued before the next key was registered.
+	ErrConnectionIDsExhausted = errors.New("quicpipe: connection IDs exhausted, next key is not registered yet")
+)
+
+// DefaultListenerConnectionIDs is the number of connection IDs a Listener
+// assumes its accept requests register for each key, unless their response
+// handlers call ReportConnectionIDs.
+const DefaultListenerConnectionIDs = 10
+
+// Listener accepts many dialers on one PacketConn. It registers its
+// connection ID key with the relay, after which the initial packets of
+// dialers, delivered out-of-band, are passed to Inject and the resulting
+// connections returned by Accept.
+//
+// Connections draw their connection IDs from a sequence of keys. Once half
+// of the connection IDs registered for the current key have been issued, the
+// next key is registered with the relays in the background, and connection
+// IDs are drawn from it once the current key's run out. Until the next key is
+// registered, no more connection IDs are issued, so new connections are
+// refused. Associations of earlier keys are kept alive by their connections'
+// packets.
+type Listener struct {
+	cfg *config
+
+	conn      *acceptConn
+	qln       quic.Listener
+	generator *keyGenerator
+}
+
+// keyGenerator is a quic.ConnectionIDGenerator which draws connection IDs
+// from a sequence of keys, num from each.
+type keyGenerator struct {
+	mu sync.Mutex
+
+	num int
+
+	current   *ConnectionIDGenerator
+	generated int
+
+	// next is registered with the relays, and becomes current once num
+	// connection IDs have been generated from current
+	next *ConnectionIDGenerator
+
+	// advance is signalled when next needs to be registered
+	advance chan struct{}
+}
+
+func newKeyGenerator(generator *ConnectionIDGenerator) *keyGenerator {
+	return &keyGenerator{
+		num:     DefaultListenerConnectionIDs,
+		current: generator,
+		advance: make(chan struct{}, 1),
+	}
+}
+
+func (g *keyGenerator) GenerateConnectionID() (quic.ConnectionID, error) {
+	g.mu.Lock()
+
+	if g.generated >= g.num && g.next != nil {
+		g.current, g.next, g.generated = g.next, nil, 0
+	}
+
+	exhausted := g.generated >= g.num
+
+	if !exhausted {
+		g.generated += 1
+	}
+
+	if g.next == nil && g.generated >= g.num/2 {
+		select {
+		case g.advance <- struct{}{}:
+		default:
+			// already signalled
+		}
+	}
+
+	current := g.current
+
+	g.mu.Unlock()
+
+	if exhausted {
+		// the relays would not route the current key's further
+		// connection IDs
+		return quic.ConnectionID{}, ErrConnectionIDsExhausted
+	}
+
+	return current.GenerateConnectionID()
+}
+
+func (g *keyGenerator) ConnectionIDLen() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.current.ConnectionIDLen()
+}
+
+// newNext returns a generator with a new key, to be registered as the next
+// one.
+func (g *keyGenerator) newNext() *ConnectionIDGenerator {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	next := NewConnectionIDGenerator(nil, g.current.HighBit)
+	next.Length = g.current.Length
+
+	return next
+}
+
+func (g *keyGenerator) setNext(next *ConnectionIDGenerator) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.next == nil {
+		g.next = next
+	}
+}
+
+// setNum sets the number of connection IDs drawn from each key, the number
+// the relays registered.
+func (g *keyGenerator) setNum(num int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.num = num
+}
+
+// keys returns the keys registered with the relays which connection IDs
+// are still drawn from.
+func (g *keyGenerator) keys() [][]byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	keys := [][]byte{g.current.Key}
+
+	if g.next != nil {
+		keys = append(keys, g.next.Key)
+	}
+
+	return keys
+}
+
+type connectionIDsKey struct{}
+
+// ReportConnectionIDs is called by a ResponseHandler of an accept request
+// with the number of connection IDs the relay registered for the key.
+// Listener uses it to know when to register the next key.
+func ReportConnectionIDs(ctx context.Context, num int) {
+	if fn, ok := ctx.Value(connectionIDsKey{}).(func(num int)); ok {
+		fn(num)
+	}
+}
+
+func withConnectionIDs(ctx context.Context, fn func(num int)) context.Context {
+	return context.WithValue(ctx, connectionIDsKey{}, fn)
+}
+
+type listenerConn struct {
+	quicConn quic.Connection
+}
+
+func (c *listenerConn) Connection() quic.Connection {
+	return c.quicConn
+}
+
+// Listen registers with the relay and starts listening for dialers on the
+// PacketConn.
+func Listen(ctx context.Context, pconn net.PacketConn, options ...Option) (*Listener, error) {
+	cfg := &config{}
+
+	for _, option := range options {
+		if err := option(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.direct.enabled {
+		// all connections share the relay's address
+		return nil, ErrListenerDirectPath
+	}
+
+	cfg.finish()
+
+	return listen(ctx, pconn, cfg)
+}
+
+func listen(ctx context.Context, pconn net.PacketConn, cfg *config) (*Listener, error) {
+	ln := &Listener{
+		cfg:       cfg,
+		conn:      newAcceptConn(ctx, pconn, newRelayPaths(len(cfg.accept.fns), nil)),
+		generator: newKeyGenerator(cfg.p2p.qcfg.ConnectionIDGenerator.(*ConnectionIDGenerator)),
+	}
+
+	if cfg.direct.enabled {
+		direct, err := newDirectPath(pconn)
+		if err != nil {
+			return nil, err
+		}
+
+		ln.conn.direct = direct
+	}
+
+	if err := ln.Register(ctx); err != nil {
+		return nil, err
+	}
+
+	qcfg := cfg.p2p.qcfg.Clone()
+	qcfg.ConnectionIDGenerator = ln.generator
+
+	qln, err := quic.Listen(ln.conn, cfg.p2p.tls, qcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ln.qln = qln
+
+	if len(cfg.accept.fns) > 1 {
+		go ln.conn.relays.run(ln.conn.closed, ln.conn.direct)
+	}
+
+	go ln.advance()
+
+	return ln, nil
+}
+
+// advance registers the next key when the generator asks for it. Failed
+// registrations are retried when the next connection ID is generated.
+func (l *Listener) advance() {
+	for {
+		select {
+		case <-l.generator.advance:
+			// register the next key
+
+		case <-l.conn.closed:
+			return
+		}
+
+		next := l.generator.newNext()
+
+		err := func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), relayRegisterTimeout)
+			defer cancel()
+
+			return l.register(ctx, next.Key)
+		}()
+		if err != nil {
+			continue
+		}
+
+		l.generator.setNext(next)
+	}
+}
+
+// Register (re-)registers the listener's current and next connection ID keys
+// with the relays. Call it periodically to keep the registrations from
+// expiring. It only fails if no relay accepted a registration.
+func (l *Listener) Register(ctx context.Context) error {
+	for _, key := range l.generator.keys() {
+		if err := l.register(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// register registers the key with the relays, learning the number of
+// connection IDs they registered from ReportConnectionIDs. It only fails if
+// no relay accepted the registration.
+func (l *Listener) register(ctx context.Context, key []byte) error {
+	var (
+		registered bool
+		firstErr   error
+		num        int
+	)
+
+	ctx = withConnectionIDs(ctx, func(n int) {
+		if n > 0 && (num == 0 || n < num) {
+			num = n
+		}
+	})
+
+	for i, fn := range l.cfg.accept.fns {
+		err := func() error {
+			ctx, cancel := relayContext(ctx, len(l.cfg.accept.fns))
+			defer cancel()
+
+			req, resh, err := fn(ctx, key)
+			if err != nil {
+				return err
+			}
+
+			relayAddr, err := relayRequest(withReflexiveAddr(ctx, l.conn.direct), l.cfg, l.conn, req, resh)
+			if err != nil {
+				return err
+			}
+
+			l.conn.relays.registered(i, relayAddr)
+
+			return nil
+		}()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		registered = true
+	}
+
+	if !registered {
+		return firstErr
+	}
+
+	if num > 0 {
+		l.generator.setNum(num)
+	}
+
+	return nil
+}
+
+// Inject passes the initial packet of a dialer, delivered out-of-band, to
+// the listener. It blocks until the listener reads it.
+func (l *Listener) Inject(packet []byte) error {
+	p := make([]byte, len(packet))
+	copy(p, packet)
+
+	return l.conn.inject(p)
+}
+
+// Accept returns the next connection established by a dialer.
+func (l *Listener) Accept(ctx context.Context) (Connection, error) {
+	qconn, err := l.qln.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &listenerConn{
+		quicConn: qconn,
+	}, nil
+}
+
+// Addr returns the local address of the PacketConn.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close closes the listener, all of its connections and the PacketConn.
+func (l *Listener) Close() error {
+	err := l.qln.Close()
+
+	if cerr := l.conn.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
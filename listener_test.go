@@ -0,0 +1,94 @@
+package quicpipe
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeyGenerator(t *testing.T) {
+	generator := newKeyGenerator(NewConnectionIDGenerator(nil, false))
+	generator.setNum(4)
+
+	first := NewConnectionIDGenerator(generator.current.Key, false)
+
+	expect := func(expected *ConnectionIDGenerator) {
+		t.Helper()
+
+		cid, err := generator.GenerateConnectionID()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := expected.GenerateConnectionIDBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(cid.Bytes(), want) {
+			t.Fatalf("expected connection ID %x, got %x", want, cid.Bytes())
+		}
+	}
+
+	advanced := func() bool {
+		select {
+		case <-generator.advance:
+			return true
+		default:
+			return false
+		}
+	}
+
+	expect(first)
+
+	if advanced() {
+		t.Fatal("expected no advance before half of the connection IDs are used")
+	}
+
+	expect(first)
+
+	if !advanced() {
+		t.Fatal("expected advance once half of the connection IDs are used")
+	}
+
+	next := generator.newNext()
+	generator.setNext(next)
+
+	if keys := generator.keys(); len(keys) != 2 || !bytes.Equal(keys[0], first.Key) || !bytes.Equal(keys[1], next.Key) {
+		t.Fatalf("expected the current and next keys, got %x", keys)
+	}
+
+	expect(first)
+	expect(first)
+
+	second := NewConnectionIDGenerator(next.Key, false)
+
+	expect(second)
+
+	if keys := generator.keys(); len(keys) != 1 || !bytes.Equal(keys[0], next.Key) {
+		t.Fatalf("expected only the next key, got %x", keys)
+	}
+
+	expect(second)
+
+	if !advanced() {
+		t.Fatal("expected advance for the key after next")
+	}
+
+	expect(second)
+	expect(second)
+
+	// without a registered next key, no more connection IDs are issued
+	if _, err := generator.GenerateConnectionID(); !errors.Is(err, ErrConnectionIDsExhausted) {
+		t.Fatalf("expected connection IDs to be exhausted, got %v", err)
+	}
+
+	if !advanced() {
+		t.Fatal("expected advance to be retried while exhausted")
+	}
+
+	third := generator.newNext()
+	generator.setNext(third)
+
+	expect(NewConnectionIDGenerator(third.Key, false))
+}
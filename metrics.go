@@ -0,0 +1,68 @@
+package quicpipe
+
+// Names of the relay's metrics.
+const (
+	// MetricPacketsForwarded counts packets forwarded to peers.
+	MetricPacketsForwarded = "quicpipe_relay_packets_forwarded_total"
+
+	// MetricBytesForwarded counts bytes forwarded to peers.
+	MetricBytesForwarded = "quicpipe_relay_bytes_forwarded_total"
+
+	// MetricPacketsUnknownCID counts packets dropped as no association has
+	// their destination connection ID.
+	MetricPacketsUnknownCID = "quicpipe_relay_packets_unknown_cid_total"
+
+	// MetricPacketsUnparsable counts packets that could not be parsed as
+	// QUIC, which are handed to the HTTP/3 server.
+	MetricPacketsUnparsable = "quicpipe_relay_packets_unparsable_total"
+
+	// MetricPacketsHTTP3 counts packets handed to the HTTP/3 server.
+	MetricPacketsHTTP3 = "quicpipe_relay_packets_http3_total"
+
+	// MetricPacketsOverQuota counts packets dropped as their association
+	// is over its quota.
+	MetricPacketsOverQuota = "quicpipe_relay_packets_over_quota_total"
+
+	// MetricPacketsRateLimited counts packets dropped by the source or
+	// destination rate limits.
+	MetricPacketsRateLimited = "quicpipe_relay_packets_rate_limited_total"
+
+	// MetricPacketsSpoofed counts packets dropped by source verification.
+	MetricPacketsSpoofed = "quicpipe_relay_packets_spoofed_total"
+
+	// MetricStoreErrors counts failed store lookups.
+	MetricStoreErrors = "quicpipe_relay_store_errors_total"
+
+	// MetricAssociations is a gauge of the associations in a MapStore.
+	MetricAssociations = "quicpipe_relay_associations"
+
+	// MetricSessions is a gauge of the sessions in a MapStore.
+	MetricSessions = "quicpipe_relay_sessions"
+)
+
+// Metrics receives the relay's counters and gauges. It must be safe for
+// concurrent use. The metrics package implements it with a text exposition
+// handler.
+type Metrics interface {
+	// Add adds delta to a counter.
+	Add(name string, delta uint64)
+
+	// Set sets a gauge.
+	Set(name string, value int64)
+}
+
+func addMetric(m Metrics, name string, delta uint64) {
+	if m != nil {
+		m.Add(name, delta)
+	}
+}
+
+// WithMetrics reports the relay's metrics to m. It only applies to
+// NewServerConnectionWithOptions.
+func WithMetrics(m Metrics) Option {
+	return func(c *config) error {
+		c.server.metrics = m
+
+		return nil
+	}
+}
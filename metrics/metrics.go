@@ -0,0 +1,182 @@
+// Package metrics collects quicpipe's metrics and serves them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hf/quicpipe"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+// ContentType of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric struct {
+	typ  string
+	help string
+
+	value int64 // counters are stored as uint64
+	fn    func() float64
+}
+
+// Registry implements quicpipe.Metrics, and serves all metrics added to it
+// over HTTP. Metrics are created the first time they are reported.
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]*metric
+}
+
+// New creates a Registry which describes quicpipe's metrics.
+func New() *Registry {
+	r := &Registry{
+		metrics: make(map[string]*metric),
+	}
+
+	r.Describe(quicpipe.MetricPacketsForwarded, "Packets forwarded to peers.")
+	r.Describe(quicpipe.MetricBytesForwarded, "Bytes forwarded to peers.")
+	r.Describe(quicpipe.MetricPacketsUnknownCID, "Packets dropped for an unknown connection ID.")
+	r.Describe(quicpipe.MetricPacketsUnparsable, "Packets that could not be parsed as QUIC.")
+	r.Describe(quicpipe.MetricPacketsHTTP3, "Packets handed to the HTTP/3 server.")
+	r.Describe(quicpipe.MetricPacketsOverQuota, "Packets dropped for an association over its quota.")
+	r.Describe(quicpipe.MetricPacketsRateLimited, "Packets dropped by rate limits.")
+	r.Describe(quicpipe.MetricPacketsSpoofed, "Packets dropped as their source is not a peer of the destination.")
+	r.Describe(quicpipe.MetricStoreErrors, "Failed store lookups.")
+	r.Describe(quicpipe.MetricAssociations, "Associations in the store.")
+	r.Describe(quicpipe.MetricSessions, "Sessions in the store.")
+
+	return r
+}
+
+func (r *Registry) get(name, typ string) *metric {
+	r.mu.RLock()
+	m, ok := r.metrics[name]
+	ok = ok && m.typ != ""
+	r.mu.RUnlock()
+
+	if ok {
+		return m
+	}
+
+	// new, or only described so far
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok = r.metrics[name]
+	if !ok {
+		m = &metric{}
+		r.metrics[name] = m
+	}
+
+	if m.typ == "" {
+		m.typ = typ
+	}
+
+	return m
+}
+
+// Describe sets the help text of a metric.
+func (r *Registry) Describe(name, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &metric{}
+		r.metrics[name] = m
+	}
+
+	m.help = help
+}
+
+// Add adds delta to a counter.
+func (r *Registry) Add(name string, delta uint64) {
+	atomic.AddInt64(&r.get(name, typeCounter).value, int64(delta))
+}
+
+// Set sets a gauge.
+func (r *Registry) Set(name string, value int64) {
+	atomic.StoreInt64(&r.get(name, typeGauge).value, value)
+}
+
+// CounterFunc adds a counter whose value is read from fn when served, such
+// as RepopulatorStats or the XDP filter's Stats.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.addFunc(name, typeCounter, help, fn)
+}
+
+// GaugeFunc adds a gauge whose value is read from fn when served.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.addFunc(name, typeGauge, help, fn)
+}
+
+func (r *Registry) addFunc(name, typ, help string, fn func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics[name] = &metric{
+		typ:  typ,
+		help: help,
+		fn:   fn,
+	}
+}
+
+func (m *metric) get() float64 {
+	if m.fn != nil {
+		return m.fn()
+	}
+
+	value := atomic.LoadInt64(&m.value)
+
+	if m.typ == typeCounter {
+		return float64(uint64(value))
+	}
+
+	return float64(value)
+}
+
+// ServeHTTP writes all metrics in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.metrics))
+	metrics := make(map[string]*metric, len(r.metrics))
+
+	for name, m := range r.metrics {
+		if m.typ == "" {
+			// described, but never reported
+			continue
+		}
+
+		names = append(names, name)
+		metrics[name] = m
+	}
+	r.mu.RUnlock()
+
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", ContentType)
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, name := range names {
+		m := metrics[name]
+
+		if m.help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", name, m.help)
+		}
+
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, m.typ)
+		fmt.Fprintf(bw, "%s %v\n", name, m.get())
+	}
+}
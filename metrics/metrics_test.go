@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hf/quicpipe"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	return w.Body.String()
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := New()
+
+	if body := scrape(t, r); body != "" {
+		t.Fatalf("expected described metrics to be left out until reported, got:\n%s", body)
+	}
+
+	var metrics quicpipe.Metrics = r
+
+	metrics.Add(quicpipe.MetricPacketsForwarded, 2)
+	metrics.Add(quicpipe.MetricPacketsForwarded, 3)
+	metrics.Set(quicpipe.MetricAssociations, 7)
+	metrics.Add("custom_total", 1)
+
+	r.GaugeFunc("func_gauge", "A gauge read from a function.", func() float64 {
+		return 1.5
+	})
+
+	expected := `# TYPE custom_total counter
+custom_total 1
+# HELP func_gauge A gauge read from a function.
+# TYPE func_gauge gauge
+func_gauge 1.5
+# HELP quicpipe_relay_associations Associations in the store.
+# TYPE quicpipe_relay_associations gauge
+quicpipe_relay_associations 7
+# HELP quicpipe_relay_packets_forwarded_total Packets forwarded to peers.
+# TYPE quicpipe_relay_packets_forwarded_total counter
+quicpipe_relay_packets_forwarded_total 5
+`
+
+	if body := scrape(t, r); body != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, body)
+	}
+}
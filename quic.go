@@ -2,6 +2,7 @@ package quicpipe
 
 import (
 	"crypto/rand"
+	"errors"
 	"sync/atomic"
 
 	"github.com/lucas-clemente/quic-go"
@@ -10,14 +11,37 @@ import (
 
 const (
 	StandardQUICConnectionIDLength = 12
+
+	MinQUICConnectionIDLength = 4
+	MaxQUICConnectionIDLength = 20
 )
 
+var ErrConnectionIDLength = errors.New("quicpipe: connection ID length must be between 4 and 20 bytes")
+
+func checkConnectionIDLength(cidlen int) error {
+	if cidlen < MinQUICConnectionIDLength || cidlen > MaxQUICConnectionIDLength {
+		return ErrConnectionIDLength
+	}
+
+	return nil
+}
+
+// StandardQUICConfig sets up the QUIC config for use with quicpipe, with
+// connection IDs of StandardQUICConnectionIDLength.
 func StandardQUICConfig(qcfg *quic.Config, highbit bool) *quic.Config {
+	return StandardQUICConfigWithConnectionIDLength(qcfg, highbit, 0)
+}
+
+// StandardQUICConfigWithConnectionIDLength is like StandardQUICConfig, with
+// connection IDs of cidlen bytes. The length must be the same for the relay
+// and all peers; StandardQUICConnectionIDLength is used if it is zero.
+func StandardQUICConfigWithConnectionIDLength(qcfg *quic.Config, highbit bool, cidlen int) *quic.Config {
 	if qcfg == nil {
 		qcfg = &quic.Config{}
 	}
 
 	generator := NewConnectionIDGenerator(nil, highbit)
+	generator.Length = cidlen
 
 	qcfg.ConnectionIDGenerator = generator
 	qcfg.DisablePathMTUDiscovery = true
@@ -30,6 +54,10 @@ type ConnectionIDGenerator struct {
 	Key     []byte
 	HighBit bool
 
+	// Length of the connection IDs, StandardQUICConnectionIDLength if
+	// zero.
+	Length int
+
 	counter uint32
 }
 
@@ -86,5 +114,9 @@ func (c *ConnectionIDGenerator) GenerateConnectionID() (quic.ConnectionID, error
 }
 
 func (c *ConnectionIDGenerator) ConnectionIDLen() int {
-	return StandardQUICConnectionIDLength
+	if c.Length == 0 {
+		return StandardQUICConnectionIDLength
+	}
+
+	return c.Length
 }
@@ -0,0 +1,173 @@
+package quicpipe
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRateLimit = errors.New("quicpipe: rate limit and burst must be positive")
+
+// tokenBucket allows events at rate per second, with bursts of up to burst
+// events. It is not safe for concurrent use.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+
+		b.last = now
+	}
+}
+
+// allow takes n tokens from the bucket if there are enough.
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	b.refill(now)
+
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+
+	return true
+}
+
+// take takes n tokens from the bucket even if there are not enough, for
+// events that already happened. It returns how long until the bucket is out
+// of debt.
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	b.refill(now)
+
+	b.tokens -= n
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiterMaxKeys bounds the number of buckets a rateLimiter keeps.
+const rateLimiterMaxKeys = 64 * 1024
+
+// rateLimiter keeps a token bucket for each key, such as a source address.
+// Once maxKeys buckets are kept, the least recently used one is evicted for a
+// new key.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	rate    float64
+	burst   int
+	maxKeys int
+
+	buckets map[string]*list.Element
+
+	// lru holds the rateLimiterBuckets, most recently used first
+	lru list.List
+}
+
+type rateLimiterBucket struct {
+	key    string
+	bucket *tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		maxKeys: rateLimiterMaxKeys,
+		buckets: make(map[string]*list.Element),
+	}
+}
+
+// allow takes a token from the key's bucket if there is one.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.buckets[key]
+	if ok {
+		l.lru.MoveToFront(element)
+	} else {
+		if len(l.buckets) >= l.maxKeys {
+			l.evict()
+		}
+
+		element = l.lru.PushFront(&rateLimiterBucket{
+			key:    key,
+			bucket: newTokenBucket(l.rate, l.burst, now),
+		})
+		l.buckets[key] = element
+	}
+
+	return element.Value.(*rateLimiterBucket).bucket.allow(now, 1)
+}
+
+// evict removes the least recently used bucket. Must be called with the lock
+// held.
+func (l *rateLimiter) evict() {
+	element := l.lru.Back()
+	if element == nil {
+		return
+	}
+
+	l.lru.Remove(element)
+	delete(l.buckets, element.Value.(*rateLimiterBucket).key)
+}
+
+// WithSourceRateLimit limits the packets accepted from each source IP address
+// to rate per second, with bursts of burst packets, before they are parsed
+// or looked up in the store. Both must be positive. It only applies to
+// NewServerConnectionWithOptions.
+func WithSourceRateLimit(rate float64, burst int) Option {
+	return func(c *config) error {
+		if rate <= 0 || burst <= 0 {
+			return ErrRateLimit
+		}
+
+		c.server.sourceLimit = newRateLimiter(rate, burst)
+
+		return nil
+	}
+}
+
+// WithDestinationRateLimit limits the packets forwarded to each destination
+// connection ID to rate per second, with bursts of burst packets, before it
+// is looked up in the store. As a peer is sent packets on one of its
+// connection IDs at a time, this limits its association. Both must be
+// positive. It only applies to NewServerConnectionWithOptions.
+func WithDestinationRateLimit(rate float64, burst int) Option {
+	return func(c *config) error {
+		if rate <= 0 || burst <= 0 {
+			return ErrRateLimit
+		}
+
+		c.server.destinationLimit = newRateLimiter(rate, burst)
+
+		return nil
+	}
+}
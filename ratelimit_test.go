@@ -0,0 +1,122 @@
+package quicpipe
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	bucket := newTokenBucket(10, 5, now)
+
+	for i := 0; i < 5; i += 1 {
+		if !bucket.allow(now, 1) {
+			t.Fatalf("expected burst token %d to be allowed", i)
+		}
+	}
+
+	if bucket.allow(now, 1) {
+		t.Fatal("expected empty bucket to deny")
+	}
+
+	now = now.Add(100 * time.Millisecond)
+
+	if !bucket.allow(now, 1) {
+		t.Fatal("expected a token after refilling for 100ms at 10/s")
+	}
+
+	if bucket.allow(now, 1) {
+		t.Fatal("expected only one token after refilling for 100ms at 10/s")
+	}
+
+	now = now.Add(time.Hour)
+
+	if bucket.allow(now, 6) {
+		t.Fatal("expected refill to be capped at the burst")
+	}
+
+	if debt := bucket.take(now, 10); debt != 500*time.Millisecond {
+		t.Fatalf("expected 500ms of debt, got %v", debt)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	limiter := newRateLimiter(1, 2)
+
+	for i := 0; i < 2; i += 1 {
+		if !limiter.allow("a", now) {
+			t.Fatalf("expected packet %d from a to be allowed", i)
+		}
+	}
+
+	if limiter.allow("a", now) {
+		t.Fatal("expected a to be limited")
+	}
+
+	if !limiter.allow("b", now) {
+		t.Fatal("expected b to have its own bucket")
+	}
+
+	if !limiter.allow("a", now.Add(time.Second)) {
+		t.Fatal("expected a to be allowed after refilling")
+	}
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	limiter := newRateLimiter(1, 1)
+	limiter.maxKeys = 2
+
+	limiter.allow("old", now)
+	limiter.allow("recent", now)
+	limiter.allow("old", now)
+
+	// evicts the least recently used bucket
+	limiter.allow("new", now)
+
+	if _, ok := limiter.buckets["recent"]; ok {
+		t.Fatal("expected the least recently used bucket to be evicted")
+	}
+
+	if len(limiter.buckets) != 2 || limiter.lru.Len() != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(limiter.buckets))
+	}
+
+	if limiter.allow("old", now) {
+		t.Fatal("expected the recently used bucket to be kept")
+	}
+
+	if limiter.allow("new", now) {
+		t.Fatal("expected the new bucket to be kept")
+	}
+}
+
+func TestRateLimitOptions(t *testing.T) {
+	for _, option := range []func(rate float64, burst int) Option{
+		WithSourceRateLimit,
+		WithDestinationRateLimit,
+	} {
+		for _, limit := range []struct {
+			rate  float64
+			burst int
+		}{
+			{rate: 0, burst: 1},
+			{rate: -1, burst: 1},
+			{rate: 1, burst: 0},
+			{rate: 1, burst: -1},
+		} {
+			if err := option(limit.rate, limit.burst)(&config{}); !errors.Is(err, ErrRateLimit) {
+				t.Fatalf("expected rate %v and burst %d to be rejected, got %v", limit.rate, limit.burst, err)
+			}
+		}
+
+		if err := option(1, 1)(&config{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package quicpipe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// MaxRegisterKeyLength is the maximum length of the
+	// ConnectionIDGenerator key in a RegisterRequest.
+	MaxRegisterKeyLength = 64
+
+	// MaxRegisterSessionLength is the maximum length of the session in a
+	// RegisterRequest.
+	MaxRegisterSessionLength = 64
+
+	// DefaultMaxRegisterNum is the default maximum number of connection
+	// IDs a peer may register at once.
+	DefaultMaxRegisterNum = 64
+)
+
+// RegisterRequest is the body of a registration request.
+type RegisterRequest struct {
+	// Key is the peer's ConnectionIDGenerator key.
+	Key []byte `json:"key"`
+
+	// Num is the number of connection IDs to register. Ignored when
+	// unregistering.
+	Num int `json:"num,omitempty"`
+
+	// TTL in seconds of the association, the relay's default if zero.
+	TTL int `json:"ttl,omitempty"`
+
+	// Session pairs the dialer's and the accepter's associations, both of
+	// which present the same identifier. Ignored when unregistering.
+	Session string `json:"session,omitempty"`
+}
+
+// ValidateKey checks the length of the request's key.
+func (req RegisterRequest) ValidateKey() error {
+	if len(req.Key) < 1 || len(req.Key) > MaxRegisterKeyLength {
+		return errors.New("quicpipe: key must be between 1 and 64 bytes")
+	}
+
+	return nil
+}
+
+// Validate checks that the request registers a valid key with at most
+// maxNum connection IDs, for at most maxTTL.
+func (req RegisterRequest) Validate(maxNum int, maxTTL time.Duration) error {
+	if err := req.ValidateKey(); err != nil {
+		return err
+	}
+
+	if req.Num < 1 || req.Num > maxNum {
+		return errors.New("quicpipe: num is out of bounds")
+	}
+
+	// compared in seconds, as huge TTLs overflow a time.Duration
+	if req.TTL < 0 || int64(req.TTL) > int64(maxTTL/time.Second) {
+		return errors.New("quicpipe: ttl is out of bounds")
+	}
+
+	if len(req.Session) > MaxRegisterSessionLength {
+		return errors.New("quicpipe: session must be at most 64 bytes")
+	}
+
+	return nil
+}
+
+// Registration returns the registration of the request for the peer's
+// address.
+func (req RegisterRequest) Registration(addr net.Addr) Registration {
+	return Registration{
+		Key:     req.Key,
+		Num:     req.Num,
+		Addr:    addr,
+		TTL:     time.Duration(req.TTL) * time.Second,
+		Session: req.Session,
+	}
+}
+
+// Authorizer decides whether a registration request may be passed on to the
+// ServerConnection. Errors with an ErrorCode() string method are reported to
+// the client with that code.
+type Authorizer = func(r *http.Request, req RegisterRequest) error
+
+// RegisterResponse is the body of all responses to registration requests.
+// Error is empty on success.
+type RegisterResponse struct {
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Addr is the peer's address as observed by the relay, returned on
+	// successful registration and refresh.
+	Addr string `json:"addr,omitempty"`
+}
+
+type errorCoder interface {
+	ErrorCode() string
+}
+
+// RegisterError is returned by CheckRegisterResponse when the relay rejected
+// a registration. It matches any error with the same ErrorCode() with
+// errors.Is, such as the ones in the token package.
+type RegisterError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *RegisterError) Error() string {
+	return fmt.Sprintf("quicpipe: registration rejected with status %d (%s): %s", e.StatusCode, e.Code, e.Message)
+}
+
+// ErrorCode returns the code the relay reported.
+func (e *RegisterError) ErrorCode() string {
+	return e.Code
+}
+
+func (e *RegisterError) Is(target error) bool {
+	coder, ok := target.(errorCoder)
+
+	return ok && coder.ErrorCode() == e.Code
+}
+
+// CheckRegisterResponse is a ResponseHandler for registration responses,
+// such as relayhttp.Handler's. It returns a *RegisterError if the registration was
+// rejected. The peer's address observed by the relay is passed to
+// ReportReflexiveAddr.
+func CheckRegisterResponse(ctx context.Context, res *http.Response) error {
+	return RegisterResponseHandler(func(ctx context.Context, addr *net.UDPAddr) error {
+		ReportReflexiveAddr(ctx, addr)
+
+		return nil
+	})(ctx, res)
+}
+
+// RegisterResponseHandler returns a ResponseHandler which checks responses
+// like CheckRegisterResponse, and calls fn with the peer's address observed
+// by the relay, if the response has one.
+func RegisterResponseHandler(fn func(ctx context.Context, addr *net.UDPAddr) error) ResponseHandler {
+	return func(ctx context.Context, res *http.Response) error {
+		defer res.Body.Close()
+
+		var response RegisterResponse
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			if res.StatusCode == http.StatusOK {
+				return err
+			}
+
+			response.Error = "internal"
+			response.Message = http.StatusText(res.StatusCode)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			return &RegisterError{
+				StatusCode: res.StatusCode,
+				Code:       response.Error,
+				Message:    response.Message,
+			}
+		}
+
+		if response.Addr == "" {
+			return nil
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", response.Addr)
+		if err != nil {
+			return err
+		}
+
+		return fn(ctx, addr)
+	}
+}
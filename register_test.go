@@ -0,0 +1,93 @@
+package quicpipe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type codedError string
+
+func (e codedError) Error() string {
+	return string(e)
+}
+
+func (e codedError) ErrorCode() string {
+	return string(e)
+}
+
+func TestRegisterResponseHandler(t *testing.T) {
+	respond := func(status int, response RegisterResponse) (*net.UDPAddr, error) {
+		w := httptest.NewRecorder()
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+
+		var reflexive *net.UDPAddr
+
+		err := RegisterResponseHandler(func(ctx context.Context, addr *net.UDPAddr) error {
+			reflexive = addr
+			return nil
+		})(context.Background(), w.Result())
+
+		return reflexive, err
+	}
+
+	addr, err := respond(http.StatusOK, RegisterResponse{Addr: "192.0.2.1:1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr.String() != "192.0.2.1:1234" {
+		t.Fatalf("expected the relay's address, got %v", addr)
+	}
+
+	if addr, err := respond(http.StatusOK, RegisterResponse{}); err != nil || addr != nil {
+		t.Fatalf("expected no address, got %v, %v", addr, err)
+	}
+
+	denied := codedError("denied")
+
+	if _, err := respond(http.StatusForbidden, RegisterResponse{Error: "denied", Message: "no"}); !errors.Is(err, denied) {
+		t.Fatalf("expected %v, got %v", denied, err)
+	}
+
+	var registerErr *RegisterError
+	if _, err := respond(http.StatusBadRequest, RegisterResponse{Error: "bad_request"}); !errors.As(err, &registerErr) || registerErr.Code != "bad_request" || registerErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	w.WriteHeader(http.StatusBadGateway)
+
+	if err := CheckRegisterResponse(context.Background(), w.Result()); !errors.As(err, &registerErr) || registerErr.Code != "internal" {
+		t.Fatalf("expected internal error without a body, got %v", err)
+	}
+}
+
+func TestRegisterRequestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		req  RegisterRequest
+		ok   bool
+	}{
+		{"valid", RegisterRequest{Key: []byte{1}, Num: 1, TTL: 60, Session: "s"}, true},
+		{"no key", RegisterRequest{Num: 1}, false},
+		{"long key", RegisterRequest{Key: make([]byte, MaxRegisterKeyLength+1), Num: 1}, false},
+		{"no num", RegisterRequest{Key: []byte{1}}, false},
+		{"too many", RegisterRequest{Key: []byte{1}, Num: 11}, false},
+		{"negative ttl", RegisterRequest{Key: []byte{1}, Num: 1, TTL: -1}, false},
+		{"long ttl", RegisterRequest{Key: []byte{1}, Num: 1, TTL: 61}, false},
+		{"long session", RegisterRequest{Key: []byte{1}, Num: 1, Session: string(make([]byte, MaxRegisterSessionLength+1))}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.req.Validate(10, time.Minute); (err == nil) != test.ok {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
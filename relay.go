@@ -0,0 +1,268 @@
+package quicpipe
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+const (
+	// relayRegisterTimeout is how long registering with one of several
+	// relays may take before the next one is tried.
+	relayRegisterTimeout = 5 * time.Second
+
+	// relayTimeout is how long the current relay may be silent before
+	// switching to another one.
+	relayTimeout = 5 * time.Second
+
+	// relayKeepAlivePeriod is the QUIC keep-alive period used when none is
+	// configured, so that a working relay is never silent.
+	relayKeepAlivePeriod = 2 * time.Second
+)
+
+// relayRequest sends a request to a relay over an HTTP/3 connection on the
+// PacketConn and passes the response to the handler. It returns the relay's
+// address.
+func relayRequest(ctx context.Context, cfg *config, pconn net.PacketConn, req *http.Request, resh ResponseHandler) (*net.UDPAddr, error) {
+	var relayAddr *net.UDPAddr
+
+	quicrt := &http3.RoundTripper{
+		QuicConfig: cfg.relay.qcfg,
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, qcfg *quic.Config) (quic.EarlyConnection, error) {
+			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+
+			relayAddr = udpAddr
+
+			if cfg.relay.tls != nil {
+				if err := cfg.relay.tls(ctx, tlsCfg); err != nil {
+					return nil, err
+				}
+			}
+
+			return quic.DialEarlyContext(ctx, pconn, udpAddr, addr, tlsCfg, qcfg)
+		},
+	}
+
+	quicclient := &http.Client{
+		Transport: quicrt,
+	}
+
+	res, err := quicclient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resh(ctx, res); err != nil {
+		quicrt.Close()
+
+		return nil, err
+	}
+
+	if err := quicrt.Close(); err != nil {
+		return nil, err
+	}
+
+	return relayAddr, nil
+}
+
+// relayContext limits registering with one relay when there are others to
+// fail over to.
+func relayContext(ctx context.Context, relays int) (context.Context, context.CancelFunc) {
+	if relays < 2 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, relayRegisterTimeout)
+}
+
+type relayPath struct {
+	addr       *net.UDPAddr
+	registered bool
+	lastRecv   time.Time
+}
+
+// relayPaths sends packets meant for the peer through the current relay out
+// of an ordered list of relays, and switches to another one when the current
+// relay goes silent. The peer must be registered with the relays too.
+//
+// quic-go sends packets for the peer to addr, which is compared by identity
+// so that packets of the HTTP/3 connections to the relays themselves are
+// never rerouted.
+type relayPaths struct {
+	mu sync.Mutex
+
+	addr    *net.UDPAddr
+	paths   []relayPath
+	current int
+}
+
+// newRelayPaths creates paths for n relays. If addr is nil, the address of
+// the first relay registered with is used.
+func newRelayPaths(n int, addr *net.UDPAddr) *relayPaths {
+	r := &relayPaths{
+		paths:   make([]relayPath, n),
+		current: -1,
+	}
+
+	if addr != nil {
+		r.addr = copyUDPAddr(addr)
+	}
+
+	return r
+}
+
+func copyUDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	c := *addr
+	return &c
+}
+
+// peerAddr returns the address quic-go sends packets for the peer to.
+func (r *relayPaths) peerAddr() *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.addr
+}
+
+// registered marks the i-th relay as usable. The first relay registered with
+// becomes the current one.
+func (r *relayPaths) registered(i int, addr *net.UDPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.paths[i] = relayPath{
+		addr:       addr,
+		registered: true,
+		lastRecv:   time.Now(),
+	}
+
+	if r.addr == nil {
+		r.addr = copyUDPAddr(addr)
+	}
+
+	if r.current < 0 {
+		r.current = i
+	}
+}
+
+// route returns the address a packet to addr should be sent to.
+func (r *relayPaths) route(addr net.Addr) net.Addr {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if udpAddr != r.addr || r.current < 0 {
+		return addr
+	}
+
+	return r.paths[r.current].addr
+}
+
+// receive records a packet read from addr.
+func (r *relayPaths) receive(addr net.Addr) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.paths {
+		path := &r.paths[i]
+
+		if path.registered && path.addr.Port == udpAddr.Port && path.addr.IP.Equal(udpAddr.IP) {
+			path.lastRecv = now
+		}
+	}
+}
+
+// failover switches away from the current relay if it has been silent. It
+// prefers a relay the peer is sending through, and otherwise tries the next
+// registered one.
+func (r *relayPaths) failover(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.current < 0 || now.Sub(r.paths[r.current].lastRecv) <= relayTimeout {
+		return
+	}
+
+	next := -1
+
+	for i := 1; i < len(r.paths); i++ {
+		j := (r.current + i) % len(r.paths)
+		path := &r.paths[j]
+
+		if !path.registered {
+			continue
+		}
+
+		if now.Sub(path.lastRecv) <= relayTimeout {
+			// the peer is using this relay
+			next = j
+			break
+		}
+
+		if next < 0 {
+			next = j
+		}
+	}
+
+	if next < 0 {
+		return
+	}
+
+	r.current = next
+
+	// give the new relay time to deliver packets
+	r.paths[next].lastRecv = now
+}
+
+// hold keeps the current relay from being switched away from, while packets
+// flow over another path.
+func (r *relayPaths) hold(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.current >= 0 {
+		r.paths[r.current].lastRecv = now
+	}
+}
+
+// run fails over between relays until done is closed. No failover happens
+// while the direct path, which may be nil, is active.
+func (r *relayPaths) run(done <-chan struct{}, direct *directPath) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case now := <-ticker.C:
+			if direct != nil && direct.isActive() {
+				r.hold(now)
+				continue
+			}
+
+			r.failover(now)
+		}
+	}
+}
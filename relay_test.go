@@ -0,0 +1,131 @@
+package quicpipe
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayPathsRoute(t *testing.T) {
+	r := newRelayPaths(2, nil)
+
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+
+	r.registered(1, second)
+	r.registered(0, first)
+
+	peer := r.peerAddr()
+
+	if peer == second || !peer.IP.Equal(second.IP) || peer.Port != second.Port {
+		t.Fatalf("expected a copy of the first registered relay's address, got %v", peer)
+	}
+
+	if addr := r.route(peer); addr != second {
+		t.Fatalf("expected packets for the peer to go to the first registered relay, got %v", addr)
+	}
+
+	// the relay's own address is not the peer's, even though it is equal
+	if addr := r.route(second); addr != second {
+		t.Fatalf("expected packets for the relay itself not to be rerouted, got %v", addr)
+	}
+
+	if addr := r.route(first); addr != first {
+		t.Fatalf("expected packets for other relays not to be rerouted, got %v", addr)
+	}
+}
+
+func TestRelayPathsFailover(t *testing.T) {
+	relays := []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+		{IP: net.IPv4(192, 0, 2, 2), Port: 443},
+		{IP: net.IPv4(192, 0, 2, 3), Port: 443},
+		{IP: net.IPv4(192, 0, 2, 4), Port: 443},
+	}
+
+	r := newRelayPaths(len(relays), nil)
+
+	// the second relay failed to register
+	r.registered(0, relays[0])
+	r.registered(2, relays[2])
+	r.registered(3, relays[3])
+
+	peer := r.peerAddr()
+	now := time.Now()
+
+	expect := func(relay *net.UDPAddr) {
+		t.Helper()
+
+		if addr := r.route(peer); addr != relay {
+			t.Fatalf("expected packets to go to %v, got %v", relay, addr)
+		}
+	}
+
+	r.failover(now)
+	expect(relays[0])
+
+	// silent relays are switched away from, to the next registered one
+	now = now.Add(relayTimeout + time.Second)
+	r.failover(now)
+	expect(relays[2])
+
+	// the new relay is given time to deliver packets
+	r.failover(now.Add(relayTimeout))
+	expect(relays[2])
+
+	// packets from the current relay keep it
+	now = now.Add(relayTimeout + time.Second)
+	r.mu.Lock()
+	r.paths[2].lastRecv = now
+	r.mu.Unlock()
+
+	r.failover(now.Add(time.Second))
+	expect(relays[2])
+
+	// a relay the peer sends through is preferred over the next one
+	now = now.Add(relayTimeout + time.Second)
+	r.mu.Lock()
+	r.paths[0].lastRecv = now
+	r.mu.Unlock()
+
+	r.failover(now)
+	expect(relays[0])
+
+	// held while another path is active
+	now = now.Add(relayTimeout + time.Second)
+	r.hold(now)
+	r.failover(now)
+	expect(relays[0])
+}
+
+func TestRelayPathsReceive(t *testing.T) {
+	relay := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+
+	r := newRelayPaths(1, nil)
+	r.registered(0, relay)
+
+	r.mu.Lock()
+	r.paths[0].lastRecv = time.Time{}
+	r.mu.Unlock()
+
+	// another port of the same host is not the relay
+	r.receive(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 444})
+
+	r.mu.Lock()
+	lastRecv := r.paths[0].lastRecv
+	r.mu.Unlock()
+
+	if !lastRecv.IsZero() {
+		t.Fatal("expected packets from another port not to count for the relay")
+	}
+
+	r.receive(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To16(), Port: 443})
+
+	r.mu.Lock()
+	lastRecv = r.paths[0].lastRecv
+	r.mu.Unlock()
+
+	if lastRecv.IsZero() {
+		t.Fatal("expected packets from the relay to be recorded")
+	}
+}
@@ -0,0 +1,200 @@
+package relayhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hf/quicpipe"
+)
+
+const (
+	// DefaultNum is the default number of connection IDs a Client
+	// registers.
+	DefaultNum = 10
+)
+
+// Error is returned by CheckResponse when the relay rejected a request. It
+// matches any error with the same ErrorCode() with errors.Is, such as the
+// ones in the token package.
+type Error = quicpipe.RegisterError
+
+// CheckResponse is a quicpipe.ResponseHandler for responses from Handler. It
+// returns an *Error if the request was rejected. The peer's address observed
+// by the relay is passed to quicpipe.ReportReflexiveAddr.
+func CheckResponse(ctx context.Context, res *http.Response) error {
+	return quicpipe.CheckRegisterResponse(ctx, res)
+}
+
+// AddrResponseHandler returns a quicpipe.ResponseHandler which checks
+// responses like CheckResponse, and calls fn with the peer's address observed
+// by the relay, if the response has one.
+func AddrResponseHandler(fn func(ctx context.Context, addr *net.UDPAddr) error) quicpipe.ResponseHandler {
+	return quicpipe.RegisterResponseHandler(fn)
+}
+
+// Client is the peer side of the registration protocol.
+type Client struct {
+	// URL of the relay, such as https://relay.example.com:4433. Its host
+	// is also the relay's UDP address.
+	URL string
+
+	// Num of connection IDs to register, DefaultNum if zero.
+	Num int
+
+	// TTL of the association, the relay's default if zero.
+	TTL time.Duration
+
+	// Session pairs the association with the other peer's, which must
+	// register with the same session. It should be unguessable, such as
+	// one chosen by the application backend for both peers.
+	Session string
+
+	// Token, if not nil, returns the bearer token sent with each request.
+	// No token is sent if it returns an empty string.
+	Token func(ctx context.Context) (string, error)
+
+	// InitialPacket is called with the dialer's initial packet once the
+	// dialer has registered with the relay. It must be delivered to the
+	// accepter out-of-band.
+	InitialPacket func(ctx context.Context, packet []byte) error
+}
+
+func (c *Client) request(ctx context.Context, path string, body *Request) (*http.Request, error) {
+	buffer := &bytes.Buffer{}
+
+	if body != nil {
+		if err := json.NewEncoder(buffer).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+path, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if c.Token != nil {
+		token, err := c.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	return req, nil
+}
+
+func (c *Client) num() int {
+	if c.Num == 0 {
+		return DefaultNum
+	}
+
+	return c.Num
+}
+
+func (c *Client) registerRequest(ctx context.Context, path string, key []byte) (*http.Request, error) {
+	var body *Request
+
+	if key != nil {
+		body = &Request{
+			Key:     key,
+			Num:     c.num(),
+			TTL:     int(c.TTL / time.Second),
+			Session: c.Session,
+		}
+	}
+
+	return c.request(ctx, path, body)
+}
+
+// DialRequest returns a function to use with quicpipe.WithDialRequest.
+func (c *Client) DialRequest() quicpipe.CreateDialRequestFunc {
+	return func(ctx context.Context, packet []byte, cid []byte) (*http.Request, quicpipe.ResponseHandler, error) {
+		req, err := c.registerRequest(ctx, RegisterPath, cid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return req, func(ctx context.Context, res *http.Response) error {
+			if err := CheckResponse(ctx, res); err != nil {
+				return err
+			}
+
+			if packet != nil && c.InitialPacket != nil {
+				return c.InitialPacket(ctx, packet)
+			}
+
+			return nil
+		}, nil
+	}
+}
+
+// AcceptRequest returns a function to use with quicpipe.WithAcceptRequest.
+// It reports the number of registered connection IDs with
+// quicpipe.ReportConnectionIDs.
+func (c *Client) AcceptRequest() quicpipe.CreateAcceptRequestFunc {
+	return func(ctx context.Context, cid []byte) (*http.Request, quicpipe.ResponseHandler, error) {
+		req, err := c.registerRequest(ctx, RegisterPath, cid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		num := c.num()
+
+		return req, func(ctx context.Context, res *http.Response) error {
+			if err := CheckResponse(ctx, res); err != nil {
+				return err
+			}
+
+			quicpipe.ReportConnectionIDs(ctx, num)
+
+			return nil
+		}, nil
+	}
+}
+
+// RefreshRequest returns a request which refreshes the registration of the
+// key, keeping it from expiring.
+func (c *Client) RefreshRequest(ctx context.Context, key []byte) (*http.Request, quicpipe.ResponseHandler, error) {
+	req, err := c.registerRequest(ctx, RefreshPath, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req, CheckResponse, nil
+}
+
+// UnregisterRequest returns a request which removes the registration of the
+// key.
+func (c *Client) UnregisterRequest(ctx context.Context, key []byte) (*http.Request, quicpipe.ResponseHandler, error) {
+	req, err := c.request(ctx, UnregisterPath, &Request{
+		Key: key,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req, CheckResponse, nil
+}
+
+// AddrRequest returns a request for the peer's address as observed by the
+// relay. It must be sent from the same socket as the peer's QUIC packets to
+// be of any use. The response handler reports the address with
+// quicpipe.ReportReflexiveAddr; use AddrResponseHandler to get it directly.
+func (c *Client) AddrRequest(ctx context.Context) (*http.Request, quicpipe.ResponseHandler, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+AddrPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req, CheckResponse, nil
+}
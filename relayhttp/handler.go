@@ -0,0 +1,290 @@
+// Package relayhttp implements the Quicpipe registration protocol over HTTP.
+//
+// Peers register, refresh and unregister the connection IDs derived from
+// their ConnectionIDGenerator key with POST requests carrying a JSON Request
+// to the Version prefixed paths below. The relay answers with a JSON Response.
+// A GET request to AddrPath only returns the peer's address as observed by
+// the relay. Handler implements the relay side, Client the peer side.
+package relayhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/hf/quicpipe"
+)
+
+const (
+	// Version of the wire format, used as the prefix of all paths.
+	Version = "v1"
+
+	RegisterPath   = "/" + Version + "/register"
+	RefreshPath    = "/" + Version + "/refresh"
+	UnregisterPath = "/" + Version + "/unregister"
+
+	// AddrPath returns the address the request came from, like STUN.
+	AddrPath = "/" + Version + "/addr"
+
+	// DefaultMaxConnectionIDs is the default maximum number of connection
+	// IDs a peer may register at once.
+	DefaultMaxConnectionIDs = quicpipe.DefaultMaxRegisterNum
+
+	// MaxKeyLength is the maximum length of a ConnectionIDGenerator key.
+	MaxKeyLength = quicpipe.MaxRegisterKeyLength
+
+	// MaxSessionLength is the maximum length of a session identifier.
+	MaxSessionLength = quicpipe.MaxRegisterSessionLength
+
+	// DefaultMaxTTL is the default maximum TTL a peer may request.
+	DefaultMaxTTL = quicpipe.DefaultAssociationTTL
+)
+
+// Request is the body of register, refresh and unregister requests.
+type Request = quicpipe.RegisterRequest
+
+// Response is the body of all responses. Error is empty on success.
+type Response = quicpipe.RegisterResponse
+
+// Error codes sent by Handler.
+const (
+	CodeBadRequest    = "bad_request"
+	CodeNotFound      = "not_found"
+	CodeNotRegistered = "not_registered"
+	CodeUnauthorized  = "unauthorized"
+	CodeNotOwner      = "not_owner"
+	CodeInternal      = "internal"
+)
+
+// Authorizer decides whether a request may be passed on to the
+// ServerConnection. Errors with an ErrorCode() string method are reported to
+// the client with that code.
+type Authorizer = quicpipe.Authorizer
+
+// Identifier returns the identity of the peer making an authorized request.
+// It becomes the owner of the associations the peer registers, and only the
+// same identity may register over, refresh or unregister them.
+type Identifier = func(r *http.Request) (string, error)
+
+type errorCoder interface {
+	ErrorCode() string
+}
+
+// Handler is the relay side of the registration protocol.
+type Handler struct {
+	Conn quicpipe.ServerConnection
+
+	// Authorize, if not nil, is called before any request is passed on to
+	// Conn.
+	Authorize Authorizer
+
+	// Identify, if not nil, is called after Authorize for the owner of
+	// the request's association. All requests have the same owner if
+	// nil, so any authorized peer may take over another's association.
+	Identify Identifier
+
+	// MaxConnectionIDs a peer may register, DefaultMaxConnectionIDs if
+	// zero.
+	MaxConnectionIDs int
+
+	// MaxTTL a peer may request, DefaultMaxTTL if zero.
+	MaxTTL time.Duration
+
+	// Quota of each registered association, enforced when Conn uses
+	// quicpipe.Accounting.
+	Quota quicpipe.Quota
+}
+
+// NewHandler creates a handler for the connection with default limits.
+func NewHandler(conn quicpipe.ServerConnection, authorize Authorizer) *Handler {
+	return &Handler{
+		Conn:      conn,
+		Authorize: authorize,
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	writeResponse(w, status, Response{
+		Error:   code,
+		Message: err.Error(),
+	})
+}
+
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	code := CodeUnauthorized
+
+	var coder errorCoder
+	if errors.As(err, &coder) {
+		code = coder.ErrorCode()
+	}
+
+	writeError(w, http.StatusForbidden, code, err)
+}
+
+// RemoteAddr returns the UDP address an HTTP/3 request came from. IPv4
+// addresses received on dual-stack sockets are unmapped.
+func RemoteAddr(r *http.Request) (*net.UDPAddr, error) {
+	addrport, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrport.Addr().Unmap(), addrport.Port())), nil
+}
+
+func (h *Handler) maxConnectionIDs() int {
+	if h.MaxConnectionIDs > 0 {
+		return h.MaxConnectionIDs
+	}
+
+	return DefaultMaxConnectionIDs
+}
+
+func (h *Handler) maxTTL() time.Duration {
+	if h.MaxTTL > 0 {
+		return h.MaxTTL
+	}
+
+	return DefaultMaxTTL
+}
+
+func (h *Handler) validate(req Request, unregister bool) error {
+	if unregister {
+		return req.ValidateKey()
+	}
+
+	return req.Validate(h.maxConnectionIDs(), h.maxTTL())
+}
+
+func (h *Handler) serveAddr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, errors.New("relayhttp: method not allowed"))
+		return
+	}
+
+	addr, err := RemoteAddr(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, Response{
+		Addr: addr.String(),
+	})
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == AddrPath {
+		h.serveAddr(w, r)
+		return
+	}
+
+	var serve func(ctx context.Context, req Request, addr net.Addr, owner string) error
+
+	switch r.URL.Path {
+	case RegisterPath:
+		serve = func(ctx context.Context, req Request, addr net.Addr, owner string) error {
+			return h.Conn.RegisterWith(ctx, h.registration(req, addr, owner))
+		}
+
+	case RefreshPath:
+		serve = func(ctx context.Context, req Request, addr net.Addr, owner string) error {
+			return h.Conn.Refresh(ctx, h.registration(req, addr, owner))
+		}
+
+	case UnregisterPath:
+		serve = func(ctx context.Context, req Request, addr net.Addr, owner string) error {
+			return h.Conn.UnregisterOwner(ctx, req.Key, owner)
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, CodeNotFound, errors.New("relayhttp: no such endpoint"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, CodeBadRequest, errors.New("relayhttp: method not allowed"))
+		return
+	}
+
+	var req Request
+
+	dec := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err)
+		return
+	}
+
+	if err := h.validate(req, r.URL.Path == UnregisterPath); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err)
+		return
+	}
+
+	addr, err := RemoteAddr(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err)
+		return
+	}
+
+	if h.Authorize != nil {
+		if err := h.Authorize(r, req); err != nil {
+			writeUnauthorized(w, err)
+			return
+		}
+	}
+
+	var owner string
+
+	if h.Identify != nil {
+		owner, err = h.Identify(r)
+		if err != nil {
+			writeUnauthorized(w, err)
+			return
+		}
+	}
+
+	if err := serve(r.Context(), req, addr, owner); err != nil {
+		if errors.Is(err, quicpipe.ErrAssociationNotFound) {
+			writeError(w, http.StatusNotFound, CodeNotRegistered, err)
+			return
+		}
+
+		if errors.Is(err, quicpipe.ErrAssociationOwner) {
+			writeError(w, http.StatusForbidden, CodeNotOwner, err)
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+
+	response := Response{}
+	if r.URL.Path != UnregisterPath {
+		response.Addr = addr.String()
+	}
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+func (h *Handler) registration(req Request, addr net.Addr, owner string) quicpipe.Registration {
+	registration := req.Registration(addr)
+	registration.Quota = h.Quota
+	registration.Owner = owner
+
+	return registration
+}
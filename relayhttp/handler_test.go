@@ -0,0 +1,169 @@
+package relayhttp_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hf/quicpipe"
+	"github.com/hf/quicpipe/relayhttp"
+	"github.com/hf/quicpipe/token"
+)
+
+var secret = []byte("secret")
+
+func newServerConnection(t *testing.T) quicpipe.ServerConnection {
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { pconn.Close() })
+
+	return quicpipe.NewServerConnection(context.Background(), pconn, quicpipe.NewMapStore())
+}
+
+func mint(t *testing.T, peer string) string {
+	t.Helper()
+
+	tok, err := token.Sign(secret, token.Claims{
+		Peer:             peer,
+		MaxConnectionIDs: 10,
+		ExpiresAt:        time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tok
+}
+
+// serve sends the request to the handler, returning the checked response.
+func serve(handler http.Handler, path, tok string, req any) error {
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(req)
+
+	r := httptest.NewRequest(http.MethodPost, path, body)
+	if tok != "" {
+		r.Header.Set("Authorization", "Bearer "+tok)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return relayhttp.AddrResponseHandler(func(ctx context.Context, addr *net.UDPAddr) error {
+		return nil
+	})(context.Background(), w.Result())
+}
+
+func TestHandlerValidate(t *testing.T) {
+	handler := relayhttp.NewHandler(newServerConnection(t), nil)
+	handler.MaxTTL = time.Minute
+
+	badRequest := &relayhttp.Error{Code: relayhttp.CodeBadRequest}
+
+	tests := []struct {
+		name string
+		path string
+		req  relayhttp.Request
+		err  error
+	}{
+		{"valid", relayhttp.RegisterPath, relayhttp.Request{Key: []byte{1}, Num: 1}, nil},
+		{"no key", relayhttp.RegisterPath, relayhttp.Request{Num: 1}, badRequest},
+		{"long key", relayhttp.RegisterPath, relayhttp.Request{Key: make([]byte, relayhttp.MaxKeyLength+1), Num: 1}, badRequest},
+		{"no num", relayhttp.RegisterPath, relayhttp.Request{Key: []byte{1}}, badRequest},
+		{"too many", relayhttp.RegisterPath, relayhttp.Request{Key: []byte{1}, Num: relayhttp.DefaultMaxConnectionIDs + 1}, badRequest},
+		{"negative ttl", relayhttp.RegisterPath, relayhttp.Request{Key: []byte{1}, Num: 1, TTL: -1}, badRequest},
+		{"long ttl", relayhttp.RegisterPath, relayhttp.Request{Key: []byte{1}, Num: 1, TTL: 61}, badRequest},
+		{"overflowing ttl", relayhttp.RegisterPath, relayhttp.Request{Key: []byte{1}, Num: 1, TTL: math.MaxInt}, badRequest},
+		{"unknown", relayhttp.RefreshPath, relayhttp.Request{Key: []byte{2}, Num: 1}, &relayhttp.Error{Code: relayhttp.CodeNotRegistered}},
+		{"unregister without num", relayhttp.UnregisterPath, relayhttp.Request{Key: []byte{1}}, nil},
+		{"no endpoint", "/v1/other", relayhttp.Request{Key: []byte{1}, Num: 1}, &relayhttp.Error{Code: relayhttp.CodeNotFound}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := serve(handler, test.path, "", test.req); !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestHandlerDefaultMaxTTL(t *testing.T) {
+	handler := relayhttp.NewHandler(newServerConnection(t), nil)
+
+	maxTTL := int(relayhttp.DefaultMaxTTL / time.Second)
+
+	if err := serve(handler, relayhttp.RegisterPath, "", relayhttp.Request{Key: []byte{1}, Num: 1, TTL: maxTTL}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := serve(handler, relayhttp.RegisterPath, "", relayhttp.Request{Key: []byte{1}, Num: 1, TTL: maxTTL + 1}); !errors.Is(err, &relayhttp.Error{Code: relayhttp.CodeBadRequest}) {
+		t.Fatalf("expected TTL over DefaultMaxTTL to be rejected, got %v", err)
+	}
+}
+
+func TestHandlerToken(t *testing.T) {
+	handler := token.NewHandler(newServerConnection(t), secret)
+
+	req := relayhttp.Request{Key: []byte{1, 2, 3}, Num: 1}
+
+	if err := serve(handler, relayhttp.RegisterPath, "", req); !errors.Is(err, token.ErrMissing) {
+		t.Fatalf("expected %v, got %v", token.ErrMissing, err)
+	}
+
+	expired, err := token.Sign(secret, token.Claims{Peer: "a", MaxConnectionIDs: 10, ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := serve(handler, relayhttp.RegisterPath, expired, req); !errors.Is(err, token.ErrExpired) {
+		t.Fatalf("expected %v, got %v", token.ErrExpired, err)
+	}
+
+	if err := serve(handler, relayhttp.RegisterPath, mint(t, ""), req); !errors.Is(err, token.ErrPeerMissing) {
+		t.Fatalf("expected %v, got %v", token.ErrPeerMissing, err)
+	}
+
+	if err := serve(handler, relayhttp.RegisterPath, mint(t, "a"), req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlerOwner(t *testing.T) {
+	handler := token.NewHandler(newServerConnection(t), secret)
+
+	a, b := mint(t, "a"), mint(t, "b")
+
+	req := relayhttp.Request{Key: []byte{1, 2, 3}, Num: 2}
+
+	if err := serve(handler, relayhttp.RegisterPath, a, req); err != nil {
+		t.Fatal(err)
+	}
+
+	notOwner := &relayhttp.Error{Code: relayhttp.CodeNotOwner}
+
+	for _, path := range []string{relayhttp.RegisterPath, relayhttp.RefreshPath, relayhttp.UnregisterPath} {
+		if err := serve(handler, path, b, req); !errors.Is(err, notOwner) {
+			t.Fatalf("%s by another peer: expected %v, got %v", path, notOwner, err)
+		}
+	}
+
+	for _, path := range []string{relayhttp.RegisterPath, relayhttp.RefreshPath, relayhttp.UnregisterPath} {
+		if err := serve(handler, path, a, req); err != nil {
+			t.Fatalf("%s by the owner: %v", path, err)
+		}
+	}
+
+	if err := serve(handler, relayhttp.RegisterPath, b, req); err != nil {
+		t.Fatalf("register by another peer after unregistering: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package quicpipe
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// RejectedCIDReader is implemented by the eBPF XDP filter in the xdp package.
+type RejectedCIDReader interface {
+	SetReadDeadline(deadline time.Time) error
+	ReadRejectedCID(fn func(cid []byte) error) error
+}
+
+// Repopulator reads the CIDs rejected by the XDP filter, such as those
+// evicted from its LRU maps, and re-inserts their redirects if the Store
+// still has an association for them.
+type Repopulator struct {
+	XDP interface {
+		XDPRedirector
+		RejectedCIDReader
+	}
+
+	Store Store
+
+	// Rate limits the number of store lookups per second, unlimited if
+	// zero. Burst lookups are allowed at once.
+	Rate  float64
+	Burst int
+
+	// Accounting, if not nil, keeps redirects of associations over their
+	// quota from being re-inserted.
+	Accounting *Accounting
+
+	hits      uint64
+	misses    uint64
+	limited   uint64
+	overQuota uint64
+	errors    uint64
+}
+
+// RepopulatorStats are the counters of a Repopulator.
+type RepopulatorStats struct {
+	// Hits are rejected CIDs whose redirects were re-inserted.
+	Hits uint64
+
+	// Misses are rejected CIDs without an association.
+	Misses uint64
+
+	// Limited are rejected CIDs ignored due to rate limiting.
+	Limited uint64
+
+	// OverQuota are rejected CIDs of associations over their quota.
+	OverQuota uint64
+
+	// Errors are failed store lookups or redirect insertions.
+	Errors uint64
+}
+
+// Stats returns the current counters.
+func (r *Repopulator) Stats() RepopulatorStats {
+	return RepopulatorStats{
+		Hits:      atomic.LoadUint64(&r.hits),
+		Misses:    atomic.LoadUint64(&r.misses),
+		Limited:   atomic.LoadUint64(&r.limited),
+		OverQuota: atomic.LoadUint64(&r.overQuota),
+		Errors:    atomic.LoadUint64(&r.errors),
+	}
+}
+
+// Run repopulates rejected CIDs until the context is done or the XDP link is
+// closed.
+func (r *Repopulator) Run(ctx context.Context) error {
+	var bucket *tokenBucket
+	if r.Rate > 0 {
+		bucket = newTokenBucket(r.Rate, r.Burst, time.Now())
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// wake up regularly to check the context
+		if err := r.XDP.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			return err
+		}
+
+		err := r.XDP.ReadRejectedCID(func(cid []byte) error {
+			if bucket != nil && !bucket.allow(time.Now(), 1) {
+				atomic.AddUint64(&r.limited, 1)
+				return nil
+			}
+
+			r.repopulate(ctx, cid)
+
+			return nil
+		})
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		} else if errors.Is(err, os.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Repopulator) repopulate(ctx context.Context, cid []byte) {
+	association, err := r.Store.GetAssociation(ctx, cid)
+	if errors.Is(err, ErrAssociationNotFound) {
+		atomic.AddUint64(&r.misses, 1)
+		return
+	} else if err != nil {
+		atomic.AddUint64(&r.errors, 1)
+		return
+	}
+
+	if r.Accounting != nil && !r.Accounting.allowed(association, time.Now()) {
+		atomic.AddUint64(&r.overQuota, 1)
+		return
+	}
+
+	if err := addRedirects(r.XDP, association); err != nil {
+		atomic.AddUint64(&r.errors, 1)
+		return
+	}
+
+	atomic.AddUint64(&r.hits, 1)
+}
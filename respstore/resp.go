@@ -0,0 +1,335 @@
+package respstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBulkLength bounds the bulk strings read from the server, which
+	// only ever sends encoded associations.
+	maxBulkLength = 1024 * 1024
+
+	// maxIdleConns is the number of connections kept open between commands.
+	maxIdleConns = 16
+)
+
+// ErrProtocol is returned for replies that are not valid RESP.
+var ErrProtocol = errors.New("quicpipe/respstore: malformed reply")
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return "quicpipe/respstore: server replied: " + string(e)
+}
+
+// nestedError is an error reply within an array. The rest of the array is
+// left unread, so unlike an Error it breaks the connection.
+type nestedError struct {
+	reply Error
+}
+
+func (e *nestedError) Error() string {
+	return e.reply.Error()
+}
+
+type conn struct {
+	net.Conn
+
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+		w:    bufio.NewWriter(c),
+	}
+}
+
+// write buffers a command as an array of bulk strings.
+func (c *conn) write(args ...[]byte) {
+	c.w.WriteByte('*')
+	c.w.WriteString(strconv.Itoa(len(args)))
+	c.w.WriteString("\r\n")
+
+	for _, arg := range args {
+		c.w.WriteByte('$')
+		c.w.WriteString(strconv.Itoa(len(arg)))
+		c.w.WriteString("\r\n")
+		c.w.Write(arg)
+		c.w.WriteString("\r\n")
+	}
+}
+
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrProtocol
+	}
+
+	return line[:len(line)-2], nil
+}
+
+func (c *conn) readLength(line []byte) (int, error) {
+	n, err := strconv.Atoi(string(line))
+	if err != nil || n > maxBulkLength {
+		return 0, ErrProtocol
+	}
+
+	return n, nil
+}
+
+// read reads a reply, which is a string for simple strings, an int64 for
+// integers, a []byte for bulk strings and a []interface{} for arrays. Null
+// replies are nil. Error replies are returned as an Error, after which the
+// connection can still be used, unless they are nested in an array.
+func (c *conn) read() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+
+	case '-':
+		return nil, Error(line[1:])
+
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+
+		return n, nil
+
+	case '$':
+		n, err := c.readLength(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, ErrProtocol
+		}
+
+		return buf[:n], nil
+
+	case '*':
+		n, err := c.readLength(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, 0, n)
+
+		for i := 0; i < n; i += 1 {
+			item, err := c.read()
+
+			var reply Error
+			if errors.As(err, &reply) {
+				return nil, &nestedError{reply: reply}
+			} else if err != nil {
+				return nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		return items, nil
+	}
+
+	return nil, ErrProtocol
+}
+
+// pool keeps idle connections to the server.
+type pool struct {
+	dial     func(ctx context.Context) (net.Conn, error)
+	password string
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+// connect dials a new connection, authenticating if there is a password.
+func (p *pool) connect(ctx context.Context) (*conn, error) {
+	nc, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(nc)
+
+	if p.password == "" {
+		return c, nil
+	}
+
+	c.SetDeadline(p.deadline(ctx))
+	c.write([]byte("AUTH"), []byte(p.password))
+
+	if err := c.w.Flush(); err != nil {
+		c.Close()
+
+		return nil, err
+	}
+
+	if _, err := c.read(); err != nil {
+		c.Close()
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (p *pool) deadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+
+	return time.Now().Add(p.timeout)
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	return p.connect(ctx)
+}
+
+// put returns the connection to the pool, unless err broke it.
+func (p *pool) put(c *conn, err error) {
+	var reply Error
+
+	if err != nil && !errors.As(err, &reply) {
+		c.Close()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) >= maxIdleConns {
+		c.Close()
+		return
+	}
+
+	p.idle = append(p.idle, c)
+}
+
+// with runs fn on a connection, and returns it to the pool unless fn's error
+// broke it.
+func (p *pool) with(ctx context.Context, fn func(c *conn) error) error {
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.SetDeadline(p.deadline(ctx))
+
+	err = fn(c)
+
+	p.put(c, err)
+
+	return err
+}
+
+// do sends the commands in one round trip, returning their replies. The
+// first error reply is returned along with all replies.
+func (p *pool) do(ctx context.Context, cmds ...[][]byte) ([]interface{}, error) {
+	var replies []interface{}
+
+	err := p.with(ctx, func(c *conn) error {
+		var err error
+
+		replies, err = c.do(cmds...)
+
+		return err
+	})
+
+	return replies, err
+}
+
+// do is like pool.do, on the connection.
+func (c *conn) do(cmds ...[][]byte) ([]interface{}, error) {
+	for _, cmd := range cmds {
+		c.write(cmd...)
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+
+	replies := make([]interface{}, 0, len(cmds))
+
+	for range cmds {
+		reply, err := c.read()
+
+		var replyErr Error
+		if errors.As(err, &replyErr) {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		replies = append(replies, reply)
+	}
+
+	return replies, firstErr
+}
+
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+
+	for _, c := range p.idle {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	p.idle = nil
+
+	return firstErr
+}
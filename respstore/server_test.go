@@ -0,0 +1,337 @@
+package respstore
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is an in-process RESP server with the commands Store uses.
+type fakeServer struct {
+	t  *testing.T
+	ln net.Listener
+
+	password string
+
+	mu          sync.Mutex
+	values      map[string][]byte
+	expires     map[string]time.Time
+	versions    map[string]uint64
+	subscribers map[string][]*conn
+	commands    map[string]int
+
+	// before, if set, is called before each command is run
+	before func(cmd string)
+
+	// reply, if set, replaces the reply to the command
+	reply func(cmd string) (string, bool)
+}
+
+// newFakeServer starts a server which requires AUTH with password, if not
+// empty.
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeServer{
+		t:           t,
+		ln:          ln,
+		password:    password,
+		values:      make(map[string][]byte),
+		expires:     make(map[string]time.Time),
+		versions:    make(map[string]uint64),
+		subscribers: make(map[string][]*conn),
+		commands:    make(map[string]int),
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	go f.serve()
+
+	return f
+}
+
+func (f *fakeServer) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeServer) serve() {
+	for {
+		nc, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go f.handle(newConn(nc))
+	}
+}
+
+// hook sets the before and reply hooks.
+func (f *fakeServer) hook(before func(cmd string), reply func(cmd string) (string, bool)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.before = before
+	f.reply = reply
+}
+
+// count returns how many times the command was received.
+func (f *fakeServer) count(cmd string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.commands[cmd]
+}
+
+// ttl returns the remaining TTL of the key, zero if it does not expire.
+func (f *fakeServer) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	expires, ok := f.expires[key]
+	if !ok {
+		return 0
+	}
+
+	return time.Until(expires)
+}
+
+func (f *fakeServer) handle(c *conn) {
+	defer c.Close()
+
+	authenticated := f.password == ""
+
+	// transaction state
+	var (
+		watched map[string]uint64
+		queued  [][]string
+		multi   bool
+	)
+
+	for {
+		request, err := c.read()
+		if err != nil {
+			return
+		}
+
+		items, _ := request.([]interface{})
+
+		var args []string
+		for _, item := range items {
+			arg, _ := item.([]byte)
+			args = append(args, string(arg))
+		}
+
+		if len(args) == 0 {
+			return
+		}
+
+		cmd := strings.ToUpper(args[0])
+
+		f.mu.Lock()
+		before := f.before
+		f.mu.Unlock()
+
+		if before != nil {
+			before(cmd)
+		}
+
+		// replies to subscribers are written by other connections too
+		f.mu.Lock()
+
+		f.commands[cmd] += 1
+
+		reply, replaced := "", false
+		if f.reply != nil {
+			reply, replaced = f.reply(cmd)
+		}
+
+		switch {
+		case replaced:
+			c.w.WriteString(reply)
+
+		case cmd == "AUTH":
+			if len(args) == 2 && args[1] == f.password {
+				authenticated = true
+				c.w.WriteString("+OK\r\n")
+			} else {
+				c.w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+
+		case !authenticated:
+			c.w.WriteString("-NOAUTH Authentication required.\r\n")
+
+		case cmd == "SUBSCRIBE":
+			f.subscribers[args[1]] = append(f.subscribers[args[1]], c)
+
+			c.w.WriteString("*3\r\n")
+			writeBulk(c, "subscribe")
+			writeBulk(c, args[1])
+			c.w.WriteString(":1\r\n")
+
+		case cmd == "WATCH":
+			if watched == nil {
+				watched = make(map[string]uint64)
+			}
+
+			for _, key := range args[1:] {
+				watched[key] = f.versions[key]
+			}
+
+			c.w.WriteString("+OK\r\n")
+
+		case cmd == "UNWATCH":
+			watched = nil
+			c.w.WriteString("+OK\r\n")
+
+		case cmd == "MULTI":
+			multi = true
+			c.w.WriteString("+OK\r\n")
+
+		case cmd == "EXEC":
+			aborted := false
+			for key, version := range watched {
+				aborted = aborted || f.versions[key] != version
+			}
+
+			if !multi {
+				c.w.WriteString("-ERR EXEC without MULTI\r\n")
+			} else if aborted {
+				c.w.WriteString("*-1\r\n")
+			} else {
+				c.w.WriteString("*" + strconv.Itoa(len(queued)) + "\r\n")
+
+				for _, args := range queued {
+					f.exec(c, strings.ToUpper(args[0]), args[1:])
+				}
+			}
+
+			watched, queued, multi = nil, nil, false
+
+		case multi:
+			queued = append(queued, args)
+			c.w.WriteString("+QUEUED\r\n")
+
+		default:
+			f.exec(c, cmd, args[1:])
+		}
+
+		err = c.w.Flush()
+
+		f.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeBulk(c *conn, item string) {
+	c.w.WriteString("$" + strconv.Itoa(len(item)) + "\r\n" + item + "\r\n")
+}
+
+func writeArray(c *conn, items ...string) {
+	c.w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+
+	for _, item := range items {
+		writeBulk(c, item)
+	}
+}
+
+// get returns the value of the key, unless it expired. Must be called with
+// the lock held.
+func (f *fakeServer) get(key string) ([]byte, bool) {
+	if expires, ok := f.expires[key]; ok && time.Now().After(expires) {
+		delete(f.values, key)
+		delete(f.expires, key)
+	}
+
+	value, ok := f.values[key]
+
+	return value, ok
+}
+
+// exec runs a command. Must be called with the lock held.
+func (f *fakeServer) exec(c *conn, cmd string, args []string) {
+	switch cmd {
+	case "SET":
+		f.versions[args[0]] += 1
+		f.values[args[0]] = []byte(args[1])
+		delete(f.expires, args[0])
+
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			f.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+
+		c.w.WriteString("+OK\r\n")
+
+	case "GET":
+		value, ok := f.get(args[0])
+		if !ok {
+			c.w.WriteString("$-1\r\n")
+			return
+		}
+
+		writeBulk(c, string(value))
+
+	case "MGET":
+		c.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+
+		for _, key := range args {
+			if value, ok := f.get(key); ok {
+				writeBulk(c, string(value))
+			} else {
+				c.w.WriteString("$-1\r\n")
+			}
+		}
+
+	case "PEXPIRE":
+		if _, ok := f.get(args[0]); !ok {
+			c.w.WriteString(":0\r\n")
+			return
+		}
+
+		ms, _ := strconv.Atoi(args[1])
+		f.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		f.versions[args[0]] += 1
+
+		c.w.WriteString(":1\r\n")
+
+	case "DEL":
+		n := 0
+
+		for _, key := range args {
+			if _, ok := f.get(key); ok {
+				f.versions[key] += 1
+				delete(f.values, key)
+				delete(f.expires, key)
+				n += 1
+			}
+		}
+
+		c.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+
+	case "PUBLISH":
+		subscribers := f.subscribers[args[0]]
+
+		for _, subscriber := range subscribers {
+			if subscriber == c {
+				continue
+			}
+
+			writeArray(subscriber, "message", args[0], args[1])
+			subscriber.w.Flush()
+		}
+
+		c.w.WriteString(":" + strconv.Itoa(len(subscribers)) + "\r\n")
+
+	default:
+		c.w.WriteString("-ERR unknown command '" + cmd + "'\r\n")
+	}
+}
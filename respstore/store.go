@@ -0,0 +1,660 @@
+// Package respstore implements a quicpipe.Store shared by several relays,
+// kept in a key-value server speaking RESP, such as Redis.
+//
+// Each connection ID is a key holding its association, expiring with the
+// association's TTL. Relays cache associations locally, and publish the
+// connection IDs they change on a channel so that the others drop them from
+// their caches. Any relay can thus forward packets for any connection ID,
+// such as when several relays share one anycast or load-balanced address.
+package respstore
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hf/quicpipe"
+)
+
+const (
+	// DefaultPrefix of all keys and of the invalidation channel.
+	DefaultPrefix = "quicpipe:"
+
+	// DefaultCacheTTL is how long associations are cached, in case an
+	// invalidation is lost.
+	DefaultCacheTTL = 10 * time.Second
+
+	// DefaultNotFoundTTL is how long unknown connection IDs are cached,
+	// which keeps floods of packets for them from reaching the server.
+	DefaultNotFoundTTL = time.Second
+
+	// DefaultMaxCacheEntries is the default number of cached connection
+	// IDs.
+	DefaultMaxCacheEntries = 64 * 1024
+
+	// DefaultTimeout of each round trip to the server.
+	DefaultTimeout = time.Second
+
+	// resubscribeDelay is how long Run waits before reconnecting.
+	resubscribeDelay = time.Second
+
+	// maxRefreshes is the number of TTL refreshes running at once.
+	maxRefreshes = maxIdleConns
+
+	// maxTransactionAttempts bounds how often PutAssociationIf retries
+	// when the keys change during its transaction.
+	maxTransactionAttempts = 8
+)
+
+// ErrTransaction is returned by PutAssociationIf when the keys kept changing
+// during its transaction.
+var ErrTransaction = errors.New("quicpipe/respstore: transaction aborted by concurrent changes")
+
+type wireAssociation struct {
+	ConnectionIDs [][]byte `json:"cids"`
+	Addr          string   `json:"addr"`
+	TTL           int64    `json:"ttl,omitempty"`
+	Session       string   `json:"session,omitempty"`
+	Owner         string   `json:"owner,omitempty"`
+
+	MaxBytes uint64  `json:"max_bytes,omitempty"`
+	Rate     float64 `json:"rate,omitempty"`
+	Burst    int     `json:"burst,omitempty"`
+}
+
+func encode(association quicpipe.Association) ([]byte, error) {
+	var addr string
+	if association.Addr != nil {
+		addr = association.Addr.String()
+	}
+
+	return json.Marshal(wireAssociation{
+		ConnectionIDs: association.ConnectionIDs,
+		Addr:          addr,
+		TTL:           int64(association.TTL),
+		Session:       association.Session,
+		Owner:         association.Owner,
+		MaxBytes:      association.Quota.MaxBytes,
+		Rate:          association.Quota.Rate,
+		Burst:         association.Quota.Burst,
+	})
+}
+
+func decode(data []byte) (quicpipe.Association, error) {
+	var wa wireAssociation
+	if err := json.Unmarshal(data, &wa); err != nil {
+		return quicpipe.Association{}, err
+	}
+
+	association := quicpipe.Association{
+		ConnectionIDs: wa.ConnectionIDs,
+		TTL:           time.Duration(wa.TTL),
+		Session:       wa.Session,
+		Owner:         wa.Owner,
+		Quota: quicpipe.Quota{
+			MaxBytes: wa.MaxBytes,
+			Rate:     wa.Rate,
+			Burst:    wa.Burst,
+		},
+	}
+
+	if wa.Addr != "" {
+		addr, err := net.ResolveUDPAddr("udp", wa.Addr)
+		if err != nil {
+			return quicpipe.Association{}, err
+		}
+
+		association.Addr = addr
+	}
+
+	return association, nil
+}
+
+type cacheEntry struct {
+	association quicpipe.Association
+	found       bool
+	expires     time.Time
+
+	// refreshed is when the key's TTL was last extended by this relay
+	refreshed time.Time
+}
+
+// Store is a quicpipe.Store kept in a RESP server. Set its fields before
+// using it.
+type Store struct {
+	// Dial connects to the server. NewStore sets it to dial a TCP address.
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	// Password, if set, is sent with AUTH on each new connection.
+	Password string
+
+	// Prefix of all keys and of the invalidation channel, DefaultPrefix if
+	// empty. Relays sharing associations must use the same prefix.
+	Prefix string
+
+	// CacheTTL, NotFoundTTL, MaxCacheEntries and Timeout are the Default
+	// values if zero. A negative CacheTTL disables caching.
+	CacheTTL        time.Duration
+	NotFoundTTL     time.Duration
+	MaxCacheEntries int
+	Timeout         time.Duration
+
+	once sync.Once
+	pool *pool
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+
+	refreshes chan struct{}
+}
+
+// NewStore creates a store for the server at the TCP address.
+func NewStore(addr string) *Store {
+	return &Store{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			var dialer net.Dialer
+
+			return dialer.DialContext(ctx, "tcp", addr)
+		},
+	}
+}
+
+func (s *Store) init() {
+	s.once.Do(func() {
+		timeout := s.Timeout
+		if timeout == 0 {
+			timeout = DefaultTimeout
+		}
+
+		s.pool = &pool{
+			dial:     s.Dial,
+			password: s.Password,
+			timeout:  timeout,
+		}
+
+		s.cache = make(map[string]*cacheEntry)
+		s.refreshes = make(chan struct{}, maxRefreshes)
+	})
+}
+
+func (s *Store) prefix() string {
+	if s.Prefix != "" {
+		return s.Prefix
+	}
+
+	return DefaultPrefix
+}
+
+func (s *Store) key(cid []byte) []byte {
+	return []byte(s.prefix() + "cid:" + hex.EncodeToString(cid))
+}
+
+func (s *Store) channel() []byte {
+	return []byte(s.prefix() + "invalidate")
+}
+
+func (s *Store) cacheTTL() time.Duration {
+	if s.CacheTTL != 0 {
+		return s.CacheTTL
+	}
+
+	return DefaultCacheTTL
+}
+
+func (s *Store) notFoundTTL() time.Duration {
+	if s.NotFoundTTL != 0 {
+		return s.NotFoundTTL
+	}
+
+	return DefaultNotFoundTTL
+}
+
+func (s *Store) maxCacheEntries() int {
+	if s.MaxCacheEntries > 0 {
+		return s.MaxCacheEntries
+	}
+
+	return DefaultMaxCacheEntries
+}
+
+// cached returns the cache entry of the CID, if it has not expired.
+func (s *Store) cached(cid []byte, now time.Time) (cacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.cache[string(cid)]
+	if !ok || now.After(entry.expires) {
+		return cacheEntry{}, false
+	}
+
+	return *entry, true
+}
+
+// store caches an association, or that the CID is unknown.
+func (s *Store) store(cid []byte, association quicpipe.Association, found bool, now time.Time) {
+	if s.CacheTTL < 0 {
+		return
+	}
+
+	ttl := s.cacheTTL()
+	if !found {
+		ttl = s.notFoundTTL()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.cache[string(cid)]; !ok && len(s.cache) >= s.maxCacheEntries() {
+		s.evict(now)
+	}
+
+	s.cache[string(cid)] = &cacheEntry{
+		association: association,
+		found:       found,
+		expires:     now.Add(ttl),
+	}
+}
+
+// evict removes expired entries. If none have expired, all are removed. Must
+// be called with the lock held.
+func (s *Store) evict(now time.Time) {
+	for cid, entry := range s.cache {
+		if now.After(entry.expires) {
+			delete(s.cache, cid)
+		}
+	}
+
+	if len(s.cache) >= s.maxCacheEntries() {
+		s.cache = make(map[string]*cacheEntry)
+	}
+}
+
+// invalidate drops the CIDs from the cache.
+func (s *Store) invalidate(cids ...[]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cid := range cids {
+		delete(s.cache, string(cid))
+	}
+}
+
+// payload encodes the CIDs for the invalidation channel.
+func payload(cids [][]byte) []byte {
+	encoded := make([]string, 0, len(cids))
+
+	for _, cid := range cids {
+		encoded = append(encoded, hex.EncodeToString(cid))
+	}
+
+	return []byte(strings.Join(encoded, " "))
+}
+
+// puts returns the commands putting the association and publishing its CIDs.
+func (s *Store) puts(association quicpipe.Association) ([][][]byte, error) {
+	data, err := encode(association)
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([][][]byte, 0, len(association.ConnectionIDs)+1)
+
+	for _, cid := range association.ConnectionIDs {
+		cmd := [][]byte{[]byte("SET"), s.key(cid), data}
+
+		if association.TTL > 0 {
+			cmd = append(cmd, []byte("PX"), []byte(strconv.FormatInt(association.TTL.Milliseconds(), 10)))
+		}
+
+		cmds = append(cmds, cmd)
+	}
+
+	return append(cmds, [][]byte{[]byte("PUBLISH"), s.channel(), payload(association.ConnectionIDs)}), nil
+}
+
+func (s *Store) PutAssociation(ctx context.Context, association quicpipe.Association) error {
+	s.init()
+
+	cmds, err := s.puts(association)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.pool.do(ctx, cmds...)
+
+	// after writing, or a lookup in the meantime could cache the old
+	// association again; even failed writes may have been applied
+	s.invalidate(association.ConnectionIDs...)
+
+	return err
+}
+
+// PutAssociationIf implements quicpipe.ConditionalStore with an optimistic
+// transaction. The keys are watched while the associations holding them are
+// checked, and the transaction is retried if any of them changed before it
+// was committed, up to a few times before returning ErrTransaction.
+func (s *Store) PutAssociationIf(ctx context.Context, association quicpipe.Association, check func(replaced []quicpipe.Association) error) error {
+	s.init()
+
+	if len(association.ConnectionIDs) == 0 {
+		if err := check(nil); err != nil {
+			return err
+		}
+
+		return s.PutAssociation(ctx, association)
+	}
+
+	cmds, err := s.puts(association)
+	if err != nil {
+		return err
+	}
+
+	watch := [][]byte{[]byte("WATCH")}
+	get := [][]byte{[]byte("MGET")}
+
+	for _, cid := range association.ConnectionIDs {
+		watch = append(watch, s.key(cid))
+		get = append(get, s.key(cid))
+	}
+
+	transaction := append(append([][][]byte{{[]byte("MULTI")}}, cmds...), [][]byte{[]byte("EXEC")})
+
+	for i := 0; i < maxTransactionAttempts; i += 1 {
+		var checkErr error
+
+		committed := false
+
+		err := s.pool.with(ctx, func(c *conn) error {
+			replies, err := c.do(watch, get)
+			if err != nil {
+				return err
+			}
+
+			values, _ := replies[1].([]interface{})
+
+			replaced, err := decodeAll(values)
+			if err != nil {
+				return err
+			}
+
+			if checkErr = check(replaced); checkErr != nil {
+				_, err := c.do([][]byte{[]byte("UNWATCH")})
+				return err
+			}
+
+			replies, err = c.do(transaction...)
+			if err != nil {
+				return err
+			}
+
+			// EXEC replies with null if a watched key changed
+			_, committed = replies[len(replies)-1].([]interface{})
+
+			return nil
+		})
+
+		s.invalidate(association.ConnectionIDs...)
+
+		switch {
+		case err != nil:
+			return err
+
+		case checkErr != nil:
+			return checkErr
+
+		case committed:
+			return nil
+		}
+	}
+
+	return ErrTransaction
+}
+
+// decodeAll decodes the distinct associations among the values.
+func decodeAll(values []interface{}) ([]quicpipe.Association, error) {
+	var associations []quicpipe.Association
+
+	seen := make(map[string]bool)
+
+	for _, value := range values {
+		data, ok := value.([]byte)
+		if !ok || seen[string(data)] {
+			continue
+		}
+
+		seen[string(data)] = true
+
+		association, err := decode(data)
+		if err != nil {
+			return nil, err
+		}
+
+		associations = append(associations, association)
+	}
+
+	return associations, nil
+}
+
+// GetAssociation returns the association of the CID from the cache, or from
+// the server. Lookups from the cache extend the TTL of the association's
+// keys every half TTL in the background, as packets are flowing.
+func (s *Store) GetAssociation(ctx context.Context, cid []byte) (quicpipe.Association, error) {
+	s.init()
+
+	now := time.Now()
+
+	if entry, ok := s.cached(cid, now); ok {
+		if !entry.found {
+			return quicpipe.Association{}, quicpipe.ErrAssociationNotFound
+		}
+
+		if ttl := entry.association.TTL; ttl > 0 && now.Sub(entry.refreshed) > ttl/2 {
+			s.refresh(cid, entry.association, now)
+		}
+
+		return entry.association, nil
+	}
+
+	replies, err := s.pool.do(ctx, [][]byte{[]byte("GET"), s.key(cid)})
+	if err != nil {
+		return quicpipe.Association{}, err
+	}
+
+	data, ok := replies[0].([]byte)
+	if !ok {
+		s.store(cid, quicpipe.Association{}, false, now)
+
+		return quicpipe.Association{}, quicpipe.ErrAssociationNotFound
+	}
+
+	association, err := decode(data)
+	if err != nil {
+		return quicpipe.Association{}, err
+	}
+
+	s.store(cid, association, true, now)
+
+	return association, nil
+}
+
+// refresh extends the TTL of the association's keys in the background,
+// unless maxRefreshes are already running.
+func (s *Store) refresh(cid []byte, association quicpipe.Association, now time.Time) {
+	s.mu.Lock()
+	entry, ok := s.cache[string(cid)]
+	if ok {
+		// only one lookup refreshes
+		entry.refreshed = now
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case s.refreshes <- struct{}{}:
+	default:
+		// a later lookup refreshes
+		s.mu.Lock()
+		entry.refreshed = time.Time{}
+		s.mu.Unlock()
+
+		return
+	}
+
+	ttl := []byte(strconv.FormatInt(association.TTL.Milliseconds(), 10))
+
+	cmds := make([][][]byte, 0, len(association.ConnectionIDs))
+
+	for _, cid := range association.ConnectionIDs {
+		cmds = append(cmds, [][]byte{[]byte("PEXPIRE"), s.key(cid), ttl})
+	}
+
+	go func() {
+		defer func() { <-s.refreshes }()
+
+		// best effort, peers refresh their registrations too
+		s.pool.do(context.Background(), cmds...)
+	}()
+}
+
+func (s *Store) DeleteAssociation(ctx context.Context, cid []byte) error {
+	s.init()
+
+	replies, err := s.pool.do(ctx, [][]byte{[]byte("GET"), s.key(cid)})
+	if err != nil {
+		return err
+	}
+
+	data, ok := replies[0].([]byte)
+	if !ok {
+		return quicpipe.ErrAssociationNotFound
+	}
+
+	association, err := decode(data)
+	if err != nil {
+		return err
+	}
+
+	del := [][]byte{[]byte("DEL")}
+
+	for _, cid := range association.ConnectionIDs {
+		del = append(del, s.key(cid))
+	}
+
+	_, err = s.pool.do(ctx, del, [][]byte{[]byte("PUBLISH"), s.channel(), payload(association.ConnectionIDs)})
+
+	s.invalidate(association.ConnectionIDs...)
+
+	return err
+}
+
+// Run receives invalidations from other relays until the context is done.
+// Without it, associations changed by other relays stay cached for up to
+// CacheTTL. The cache is cleared whenever the subscription is interrupted.
+func (s *Store) Run(ctx context.Context) error {
+	s.init()
+
+	for {
+		err := s.subscribe(ctx)
+
+		s.mu.Lock()
+		s.cache = make(map[string]*cacheEntry)
+		s.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+
+			case <-time.After(resubscribeDelay):
+			}
+		}
+	}
+}
+
+func (s *Store) subscribe(ctx context.Context) error {
+	c, err := s.pool.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+
+		case <-done:
+		}
+	}()
+
+	c.SetDeadline(s.pool.deadline(ctx))
+	c.write([]byte("SUBSCRIBE"), s.channel())
+
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := c.read(); err != nil {
+		return err
+	}
+
+	// messages may have been missed before subscribing
+	s.mu.Lock()
+	s.cache = make(map[string]*cacheEntry)
+	s.mu.Unlock()
+
+	c.SetDeadline(time.Time{})
+
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return err
+		}
+
+		message, ok := reply.([]interface{})
+		if !ok || len(message) != 3 {
+			continue
+		}
+
+		kind, _ := message[0].([]byte)
+		data, _ := message[2].([]byte)
+
+		if string(kind) != "message" {
+			continue
+		}
+
+		var cids [][]byte
+
+		for _, field := range strings.Fields(string(data)) {
+			cid, err := hex.DecodeString(field)
+			if err == nil {
+				cids = append(cids, cid)
+			}
+		}
+
+		s.invalidate(cids...)
+	}
+}
+
+// Close closes the idle connections to the server.
+func (s *Store) Close() error {
+	s.init()
+
+	return s.pool.close()
+}
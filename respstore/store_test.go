@@ -0,0 +1,342 @@
+package respstore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hf/quicpipe"
+)
+
+func newTestStore(t *testing.T, f *fakeServer) *Store {
+	store := NewStore(f.addr())
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+
+	t.Fatal("condition not met in time")
+}
+
+func testAssociation(port int) quicpipe.Association {
+	return quicpipe.Association{
+		ConnectionIDs: [][]byte{{1, 2, 3, 4}, {5, 6, 7, 8}},
+		Addr:          &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port},
+		TTL:           time.Minute,
+		Session:       "session",
+		Owner:         "owner",
+	}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+
+	f := newFakeServer(t, "secret")
+
+	store := newTestStore(t, f)
+	store.Password = "secret"
+
+	association := testAssociation(4433)
+
+	if err := store.PutAssociation(ctx, association); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := f.ttl("quicpipe:cid:01020304"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("expected the key to expire with the association's TTL, got %v", ttl)
+	}
+
+	for i := 0; i < 2; i += 1 {
+		got, err := store.GetAssociation(ctx, []byte{5, 6, 7, 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Addr.String() != association.Addr.String() || got.TTL != association.TTL || got.Session != association.Session || got.Owner != association.Owner || len(got.ConnectionIDs) != 2 {
+			t.Fatalf("expected %+v, got %+v", association, got)
+		}
+	}
+
+	if n := f.count("GET"); n != 1 {
+		t.Fatalf("expected the second lookup to be cached, got %d GETs", n)
+	}
+
+	if err := store.DeleteAssociation(ctx, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cid := range association.ConnectionIDs {
+		if _, err := store.GetAssociation(ctx, cid); !errors.Is(err, quicpipe.ErrAssociationNotFound) {
+			t.Fatalf("expected %x to be deleted, got %v", cid, err)
+		}
+	}
+
+	if err := store.DeleteAssociation(ctx, []byte{1, 2, 3, 4}); !errors.Is(err, quicpipe.ErrAssociationNotFound) {
+		t.Fatalf("expected %v, got %v", quicpipe.ErrAssociationNotFound, err)
+	}
+
+	gets := f.count("GET")
+
+	if _, err := store.GetAssociation(ctx, []byte{1, 2, 3, 4}); !errors.Is(err, quicpipe.ErrAssociationNotFound) {
+		t.Fatalf("expected %v, got %v", quicpipe.ErrAssociationNotFound, err)
+	}
+
+	if f.count("GET") != gets {
+		t.Fatal("expected unknown connection IDs to be cached")
+	}
+}
+
+func TestStoreInvalidateAfterWrite(t *testing.T) {
+	ctx := context.Background()
+
+	f := newFakeServer(t, "")
+	store := newTestStore(t, f)
+
+	if err := store.PutAssociation(ctx, testAssociation(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetAssociation(ctx, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a lookup races with the next write
+	var once sync.Once
+	f.hook(func(cmd string) {
+		if cmd != "SET" {
+			return
+		}
+
+		once.Do(func() {
+			if _, err := store.GetAssociation(ctx, []byte{1, 2, 3, 4}); err != nil {
+				t.Error(err)
+			}
+		})
+	}, nil)
+
+	if err := store.PutAssociation(ctx, testAssociation(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetAssociation(ctx, []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port := got.Addr.(*net.UDPAddr).Port; port != 2 {
+		t.Fatalf("expected the written association, got port %d", port)
+	}
+}
+
+func TestStoreRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := newFakeServer(t, "")
+
+	a, b := newTestStore(t, f), newTestStore(t, f)
+
+	done := make(chan error)
+	go func() { done <- b.Run(ctx) }()
+
+	eventually(t, func() bool { return f.count("SUBSCRIBE") == 1 })
+
+	if err := a.PutAssociation(ctx, testAssociation(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, func() bool {
+		got, err := b.GetAssociation(ctx, []byte{1, 2, 3, 4})
+		return err == nil && got.Addr.(*net.UDPAddr).Port == 1
+	})
+
+	if err := a.PutAssociation(ctx, testAssociation(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// b's cached association is invalidated by a
+	eventually(t, func() bool {
+		got, err := b.GetAssociation(ctx, []byte{1, 2, 3, 4})
+		return err == nil && got.Addr.(*net.UDPAddr).Port == 2
+	})
+
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected Run to stop with the context, got %v", err)
+	}
+}
+
+func TestStoreRefresh(t *testing.T) {
+	ctx := context.Background()
+
+	f := newFakeServer(t, "")
+	store := newTestStore(t, f)
+
+	association := testAssociation(1)
+	association.TTL = 200 * time.Millisecond
+
+	if err := store.PutAssociation(ctx, association); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i += 1 {
+		if _, err := store.GetAssociation(ctx, []byte{1, 2, 3, 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one lookup refreshes all keys of the association
+	eventually(t, func() bool { return f.count("PEXPIRE") == len(association.ConnectionIDs) })
+
+	time.Sleep(150 * time.Millisecond)
+
+	if _, err := store.GetAssociation(ctx, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, func() bool { return f.count("PEXPIRE") == 2*len(association.ConnectionIDs) })
+
+	time.Sleep(100 * time.Millisecond)
+
+	// past the original TTL
+	if _, ok := func() ([]byte, bool) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		return f.get("quicpipe:cid:05060708")
+	}(); !ok {
+		t.Fatal("expected the refresh to extend the TTL")
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	ctx := context.Background()
+
+	f := newFakeServer(t, "")
+	store := newTestStore(t, f)
+
+	f.hook(nil, func(cmd string) (string, bool) {
+		return "-ERR failed\r\n", cmd == "GET"
+	})
+
+	var reply Error
+	if _, err := store.GetAssociation(ctx, []byte{1}); !errors.As(err, &reply) {
+		t.Fatalf("expected an error reply, got %v", err)
+	}
+
+	if len(store.pool.idle) != 1 {
+		t.Fatal("expected the connection to be reused after an error reply")
+	}
+
+	f.hook(nil, func(cmd string) (string, bool) {
+		return "*2\r\n-ERR nested\r\n+OK\r\n", cmd == "GET"
+	})
+
+	if _, err := store.GetAssociation(ctx, []byte{1}); err == nil || errors.As(err, &reply) {
+		t.Fatalf("expected a broken connection, got %v", err)
+	}
+
+	if len(store.pool.idle) != 0 {
+		t.Fatal("expected the connection to be closed after a nested error reply")
+	}
+
+	f.hook(nil, nil)
+
+	if _, err := store.GetAssociation(ctx, []byte{1}); !errors.Is(err, quicpipe.ErrAssociationNotFound) {
+		t.Fatalf("expected %v on a new connection, got %v", quicpipe.ErrAssociationNotFound, err)
+	}
+}
+
+func TestStorePutAssociationIf(t *testing.T) {
+	ctx := context.Background()
+
+	f := newFakeServer(t, "")
+
+	a, b := newTestStore(t, f), newTestStore(t, f)
+
+	owned := func(owner string) func(replaced []quicpipe.Association) error {
+		return func(replaced []quicpipe.Association) error {
+			for _, association := range replaced {
+				if association.Owner != owner {
+					return quicpipe.ErrAssociationOwner
+				}
+			}
+
+			return nil
+		}
+	}
+
+	association := testAssociation(1)
+
+	if err := a.PutAssociationIf(ctx, association, owned("owner")); err != nil {
+		t.Fatal(err)
+	}
+
+	// cached by a, to check that the transaction does not use the cache
+	if _, err := a.GetAssociation(ctx, []byte{5, 6, 7, 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	// b takes over the second CID while a's transaction is under way
+	var once sync.Once
+	f.hook(func(cmd string) {
+		if cmd != "MULTI" {
+			return
+		}
+
+		once.Do(func() {
+			other := testAssociation(2)
+			other.ConnectionIDs = [][]byte{{5, 6, 7, 8}}
+			other.Owner = "other"
+
+			if err := b.PutAssociation(ctx, other); err != nil {
+				t.Error(err)
+			}
+		})
+	}, nil)
+
+	association.Addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3}
+
+	if err := a.PutAssociationIf(ctx, association, owned("owner")); !errors.Is(err, quicpipe.ErrAssociationOwner) {
+		t.Fatalf("expected %v, got %v", quicpipe.ErrAssociationOwner, err)
+	}
+
+	if n := f.count("EXEC"); n != 2 {
+		t.Fatalf("expected a committed and an aborted transaction, got %d EXECs", n)
+	}
+
+	got, err := a.GetAssociation(ctx, []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port := got.Addr.(*net.UDPAddr).Port; port != 1 {
+		t.Fatalf("expected the rejected association to not be put, got port %d", port)
+	}
+
+	got, err = a.GetAssociation(ctx, []byte{5, 6, 7, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Owner != "other" {
+		t.Fatalf("expected the other owner's association, got %+v", got)
+	}
+
+	if len(a.pool.idle) != 1 {
+		t.Fatal("expected the connection to be reused after a failed check")
+	}
+}
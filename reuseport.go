@@ -0,0 +1,123 @@
+package quicpipe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrWorkers          = errors.New("quicpipe: at least one socket is needed")
+	ErrReusePortSupport = errors.New("quicpipe: SO_REUSEPORT is not supported on this platform")
+)
+
+type workerServerConn struct {
+	// serverConn writes with the first socket
+	*serverConn
+
+	conns []*net.UDPConn
+	queue *packetQueue
+}
+
+// ListenReusePort opens a number of UDP sockets on the same address with
+// SO_REUSEPORT, letting the kernel spread clients over them by their address.
+// If the address has no port, they all bind to the port the first one got.
+// More than one socket is only supported on Linux.
+func ListenReusePort(ctx context.Context, network, address string, n int) ([]*net.UDPConn, error) {
+	if n < 1 {
+		return nil, ErrWorkers
+	}
+
+	if n > 1 && !reusePortSupported {
+		return nil, ErrReusePortSupport
+	}
+
+	lc := net.ListenConfig{
+		Control: reusePort,
+	}
+
+	conns := make([]*net.UDPConn, 0, n)
+
+	for i := 0; i < n; i += 1 {
+		if i == 1 {
+			address = conns[0].LocalAddr().String()
+		}
+
+		pconn, err := lc.ListenPacket(ctx, network, address)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+
+			return nil, err
+		}
+
+		conns = append(conns, pconn.(*net.UDPConn))
+	}
+
+	return conns, nil
+}
+
+// NewWorkerServerConnection is like NewBatchServerConnection, but runs a
+// forwarding worker on each of the sockets, such as those of
+// ListenReusePort, so forwarding scales across cores. Packets for the HTTP/3
+// server from all sockets are handed off to the returned connection, to be
+// served by a single http3.Server. Its responses are written from the first
+// socket.
+func NewWorkerServerConnection(ctx context.Context, conns []*net.UDPConn, store Store, options ...Option) (ServerConnection, error) {
+	if len(conns) < 1 {
+		return nil, ErrWorkers
+	}
+
+	sc, err := newServerConn(ctx, conns[0], store, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &workerServerConn{
+		serverConn: sc,
+		conns:      conns,
+		queue:      newPacketQueue(),
+	}
+
+	for _, conn := range conns {
+		// workers share the store, limits and accounting
+		worker := *sc
+		worker.pconn = conn
+
+		go newBatchForwarder(&worker, conn, c.queue).run()
+	}
+
+	return c, nil
+}
+
+func (c *workerServerConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return c.queue.ReadFrom(p)
+}
+
+func (c *workerServerConn) SetReadDeadline(t time.Time) error {
+	c.queue.readDeadline.set(t)
+
+	return nil
+}
+
+func (c *workerServerConn) SetDeadline(t time.Time) error {
+	c.queue.readDeadline.set(t)
+
+	return c.conns[0].SetWriteDeadline(t)
+}
+
+func (c *workerServerConn) Close() error {
+	c.queue.close()
+
+	var firstErr error
+
+	for _, conn := range c.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package quicpipe
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// reusePort sets SO_REUSEPORT on a socket before it is bound.
+func reusePort(network, address string, rc syscall.RawConn) error {
+	var serr error
+
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+
+	return serr
+}
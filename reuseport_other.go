@@ -0,0 +1,14 @@
+//go:build !linux
+
+package quicpipe
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// reusePort does nothing, as only one worker can be started.
+func reusePort(network, address string, rc syscall.RawConn) error {
+	return nil
+}
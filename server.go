@@ -2,9 +2,7 @@ package quicpipe
 
 import (
 	"context"
-	"encoding/hex"
 	"errors"
-	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -12,121 +10,160 @@ import (
 	"github.com/hf/quicpacket"
 )
 
-type Association struct {
-	ConnectionIDs [][]byte
-	Addr          net.Addr
-}
+type serverConn struct {
+	ctx context.Context
 
-var ErrAssociationNotFound = errors.New("quicpipe: association for this connection ID does not exist")
+	pconn   net.PacketConn
+	store   Store
+	cidlen  int
+	metrics Metrics
 
-type Store interface {
-	PutAssociation(ctx context.Context, association Association) error
-	GetAssociation(ctx context.Context, cid []byte) (Association, error)
-}
+	accounting *Accounting
 
-type MapStore struct {
-	sync.Mutex
+	sourceLimit      *rateLimiter
+	destinationLimit *rateLimiter
 
-	Map map[string]net.Addr
-	XDP interface {
-		AddIPv4Redirect(addr *net.UDPAddr, cids ...[]byte) error
-	}
+	// sources is set with source verification
+	sources AddrStore
+
+	// registerMu makes registrations atomic with stores which don't
+	// implement ConditionalStore, shared by copies of the connection
+	registerMu *sync.Mutex
+}
+
+func isHTTP3ConnectionID(cid []byte) bool {
+	// high bit is set
+	return len(cid) > 0 && (cid[0]&0x80) != 0
 }
 
-func NewMapStore() *MapStore {
-	return &MapStore{
-		Map: make(map[string]net.Addr),
+// sourceKey identifies the source of a packet for rate limiting.
+func sourceKey(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return string(udpAddr.IP.To16())
 	}
+
+	return addr.String()
 }
 
-func (m *MapStore) PutAssociation(ctx context.Context, association Association) error {
-	func() {
-		m.Lock()
-		defer m.Unlock()
+func (c *serverConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.pconn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
 
-		for _, cid := range association.ConnectionIDs {
-			s := hex.EncodeToString(cid)
-			m.Map[s] = association.Addr
+		to, local, err := c.classify(p[:n], addr)
+		if err != nil {
+			return 0, nil, err
 		}
-	}()
 
-	if m.XDP != nil {
-		switch association.Addr.(type) {
-		case *net.UDPAddr:
-			fmt.Println("adding XDP association")
-			if err := m.XDP.AddIPv4Redirect(association.Addr.(*net.UDPAddr), association.ConnectionIDs...); err != nil {
-				return err
-			}
+		if local {
+			return n, addr, nil
 		}
-	}
 
-	return nil
-}
+		if to == nil {
+			continue
+		}
 
-func (m *MapStore) GetAssociation(ctx context.Context, cid []byte) (Association, error) {
-	s := hex.EncodeToString(cid)
+		// forward
+		if _, err := c.pconn.WriteTo(p[:n], to); err != nil {
+			return 0, nil, err
+		}
 
-	m.Lock()
-	defer m.Unlock()
+		addMetric(c.metrics, MetricPacketsForwarded, 1)
+		addMetric(c.metrics, MetricBytesForwarded, uint64(n))
+	}
+}
 
-	addr, ok := m.Map[s]
-	if ok {
-		return Association{
-			Addr: addr,
-		}, nil
+// classify decides what happens to a packet read from addr. Packets for the
+// relay's HTTP/3 server are local, packets for a peer are forwarded to the
+// returned address, and others are dropped.
+func (c *serverConn) classify(p []byte, addr net.Addr) (net.Addr, bool, error) {
+	if c.sourceLimit != nil && !c.sourceLimit.allow(sourceKey(addr), time.Now()) {
+		addMetric(c.metrics, MetricPacketsRateLimited, 1)
+		return nil, false, nil
 	}
 
-	return Association{}, ErrAssociationNotFound
-}
+	packet, err := quicpacket.Parse(p, c.cidlen)
+	if err != nil {
+		// unable to parse packet, send to server
+		addMetric(c.metrics, MetricPacketsUnparsable, 1)
+		addMetric(c.metrics, MetricPacketsHTTP3, 1)
 
-type serverConn struct {
-	ctx context.Context
+		return nil, true, nil
+	}
 
-	pconn net.PacketConn
-	store Store
-}
+	if packet.Form == quicpacket.LongForm {
+		if isHTTP3ConnectionID(packet.SourceConnectionID) {
+			addMetric(c.metrics, MetricPacketsHTTP3, 1)
 
-func isHTTP3ConnectionID(cid []byte) bool {
-	// high bit is set
-	return (cid[0] & 0x80) != 0
-}
+			return nil, true, nil
+		}
+	} else {
+		if isHTTP3ConnectionID(packet.DestinationConnectionID) {
+			addMetric(c.metrics, MetricPacketsHTTP3, 1)
 
-func (c *serverConn) ReadFrom(p []byte) (int, net.Addr, error) {
-	for {
-		n, addr, err := c.pconn.ReadFrom(p)
-		if err != nil {
-			return n, addr, err
+			return nil, true, nil
 		}
+	}
+
+	if c.destinationLimit != nil && !c.destinationLimit.allow(string(packet.DestinationConnectionID), time.Now()) {
+		addMetric(c.metrics, MetricPacketsRateLimited, 1)
+		return nil, false, nil
+	}
+
+	assoc, err := c.store.GetAssociation(c.ctx, packet.DestinationConnectionID)
+	if errors.Is(err, ErrAssociationNotFound) {
+		// no destination
+		addMetric(c.metrics, MetricPacketsUnknownCID, 1)
+		return nil, false, nil
+	} else if err != nil {
+		// error
+		addMetric(c.metrics, MetricStoreErrors, 1)
 
-		packet, err := quicpacket.Parse(p[:n], StandardQUICConnectionIDLength)
+		return nil, false, err
+	}
+
+	if c.sources != nil {
+		verified, err := c.verifySource(assoc, addr)
 		if err != nil {
-			// unable to parse packet, send to server
-			return n, addr, nil
+			addMetric(c.metrics, MetricStoreErrors, 1)
+
+			return nil, false, err
 		}
 
-		if packet.Form == quicpacket.LongForm {
-			if isHTTP3ConnectionID(packet.SourceConnectionID) {
-				return n, addr, nil
-			}
-		} else {
-			if isHTTP3ConnectionID(packet.DestinationConnectionID) {
-				return n, addr, nil
-			}
+		if !verified {
+			// not a peer of the destination
+			addMetric(c.metrics, MetricPacketsSpoofed, 1)
+			return nil, false, nil
 		}
+	}
 
-		assoc, err := c.store.GetAssociation(c.ctx, packet.DestinationConnectionID)
-		if errors.Is(err, ErrAssociationNotFound) {
-			// no destination
-		} else if err != nil {
-			// error
-			return 0, nil, err
-		} else {
-			// forward
-			if _, err := c.pconn.WriteTo(p[:n], assoc.Addr); err != nil {
-				return 0, nil, err
-			}
+	if c.accounting != nil && !c.accounting.forward(assoc, len(p), time.Now()) {
+		// over quota
+		addMetric(c.metrics, MetricPacketsOverQuota, 1)
+		return nil, false, nil
+	}
+
+	return assoc.Addr, false, nil
+}
+
+// verifySource returns true if the address belongs to an association with the
+// same session as the destination, or to any association if the destination
+// has no session.
+func (c *serverConn) verifySource(destination Association, addr net.Addr) (bool, error) {
+	sources, err := c.sources.GetAssociationsByAddr(c.ctx, addr)
+	if err != nil {
+		return false, err
+	}
+
+	for _, source := range sources {
+		if destination.Session == "" || source.Session == destination.Session {
+			return true, nil
 		}
 	}
+
+	return false, nil
 }
 
 func (c *serverConn) WriteTo(p []byte, addr net.Addr) (int, error) {
@@ -153,11 +190,55 @@ func (c *serverConn) LocalAddr() net.Addr {
 	return c.pconn.LocalAddr()
 }
 
+// Registration describes the connection IDs a peer registers with the relay.
+type Registration struct {
+	// Key is the key of the peer's ConnectionIDGenerator.
+	Key []byte
+
+	// Num is the number of connection IDs derived from the key.
+	Num int
+
+	// Addr is the peer's address, where packets for its connection IDs
+	// are forwarded.
+	Addr net.Addr
+
+	// TTL of the association, DefaultAssociationTTL if zero.
+	TTL time.Duration
+
+	// Quota of the association.
+	Quota Quota
+
+	// Session pairs the association with the other peer's, see
+	// Association.
+	Session string
+
+	// Owner identifies the peer registering the connection IDs, see
+	// Association.
+	Owner string
+}
+
+var ErrAssociationOwner = errors.New("quicpipe: association is registered by another owner")
+
 func (c *serverConn) Register(ctx context.Context, cid []byte, num int, addr net.Addr) error {
-	generator := NewConnectionIDGenerator(cid, false)
-	ids := make([][]byte, 0, num)
+	return c.RegisterWith(ctx, Registration{
+		Key:  cid,
+		Num:  num,
+		Addr: addr,
+	})
+}
+
+func (c *serverConn) RegisterWith(ctx context.Context, registration Registration) error {
+	return c.register(ctx, registration, false)
+}
+
+// register puts the association of the registration in the store, unless
+// any of its connection IDs belongs to an association with another owner.
+// With refresh, it must replace at least one association.
+func (c *serverConn) register(ctx context.Context, registration Registration, refresh bool) error {
+	generator := c.generator(registration.Key)
+	ids := make([][]byte, 0, registration.Num)
 
-	for i := 0; i < num; i += 1 {
+	for i := 0; i < registration.Num; i += 1 {
 		cid, err := generator.GenerateConnectionIDBytes()
 		if err != nil {
 			return err
@@ -166,27 +247,214 @@ func (c *serverConn) Register(ctx context.Context, cid []byte, num int, addr net
 		ids = append(ids, cid)
 	}
 
-	err := c.store.PutAssociation(ctx, Association{
+	ttl := registration.TTL
+	if ttl == 0 {
+		ttl = DefaultAssociationTTL
+	}
+
+	association := Association{
 		ConnectionIDs: ids,
-		Addr:          addr,
-	})
+		Addr:          registration.Addr,
+		TTL:           ttl,
+		Quota:         registration.Quota,
+		Session:       registration.Session,
+		Owner:         registration.Owner,
+	}
+
+	check := func(replaced []Association) error {
+		if refresh && len(replaced) == 0 {
+			return ErrAssociationNotFound
+		}
+
+		for _, old := range replaced {
+			if old.Owner != registration.Owner {
+				return ErrAssociationOwner
+			}
+		}
+
+		return nil
+	}
+
+	if store, ok := c.store.(ConditionalStore); ok {
+		return store.PutAssociationIf(ctx, association, check)
+	}
+
+	// other stores are only checked atomically within this connection
+	c.registerMu.Lock()
+	defer c.registerMu.Unlock()
+
+	var replaced []Association
+
+	for _, cid := range ids {
+		old, err := c.store.GetAssociation(ctx, cid)
+		if errors.Is(err, ErrAssociationNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		replaced = append(replaced, old)
+	}
+
+	if err := check(replaced); err != nil {
+		return err
+	}
+
+	return c.store.PutAssociation(ctx, association)
+}
+
+func (c *serverConn) generator(key []byte) *ConnectionIDGenerator {
+	generator := NewConnectionIDGenerator(key, false)
+	generator.Length = c.cidlen
+
+	return generator
+}
+
+// firstConnectionID returns the first connection ID derived from the key,
+// which identifies the association registered with it.
+func (c *serverConn) firstConnectionID(key []byte) ([]byte, error) {
+	return c.generator(key).GenerateConnectionIDBytes()
+}
+
+func (c *serverConn) Refresh(ctx context.Context, registration Registration) error {
+	return c.register(ctx, registration, true)
+}
+
+func (c *serverConn) Unregister(ctx context.Context, key []byte) error {
+	return c.unregister(ctx, key, "", false)
+}
+
+func (c *serverConn) UnregisterOwner(ctx context.Context, key []byte, owner string) error {
+	return c.unregister(ctx, key, owner, true)
+}
+
+func (c *serverConn) unregister(ctx context.Context, key []byte, owner string, checkOwner bool) error {
+	cid, err := c.firstConnectionID(key)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	sessions, ok := c.store.(SessionStore)
+	if !ok && !checkOwner {
+		return c.store.DeleteAssociation(ctx, cid)
+	}
+
+	association, err := c.store.GetAssociation(ctx, cid)
+	if err != nil {
+		return err
+	}
+
+	if checkOwner && association.Owner != owner {
+		return ErrAssociationOwner
+	}
+
+	if !ok || association.Session == "" {
+		return c.store.DeleteAssociation(ctx, cid)
+	}
+
+	return sessions.DeleteSession(ctx, association.Session)
 }
 
 type ServerConnection interface {
 	net.PacketConn
 
+	// Register associates num connection IDs derived from the key cid
+	// with the peer's address, like RegisterWith without an owner.
 	Register(ctx context.Context, cid []byte, num int, addr net.Addr) error
+
+	// RegisterWith associates the connection IDs derived from the key with
+	// the peer's address. It returns ErrAssociationOwner if any of them is
+	// registered with another owner. The check is atomic with stores
+	// implementing ConditionalStore, and within the connection otherwise.
+	RegisterWith(ctx context.Context, registration Registration) error
+
+	// Refresh is like RegisterWith, but returns ErrAssociationNotFound if none
+	// of the connection IDs is registered.
+	Refresh(ctx context.Context, registration Registration) error
+
+	// Unregister removes the association registered with the key, and
+	// the other associations of its session if the store is a
+	// SessionStore, regardless of its owner.
+	Unregister(ctx context.Context, key []byte) error
+
+	// UnregisterOwner is like Unregister, but returns ErrAssociationOwner
+	// if the association was registered with another owner.
+	UnregisterOwner(ctx context.Context, key []byte, owner string) error
+}
+
+var ErrSourceVerificationStore = errors.New("quicpipe: source verification needs a store implementing AddrStore")
+
+// WithSourceVerification only forwards packets whose source address is the
+// address of an association, paired with the destination if it has a
+// Session. It stops anyone who learns a connection ID from reflecting traffic
+// at a peer. The store must implement AddrStore. It only applies to
+// NewServerConnectionWithOptions; enable it in the XDP filter separately.
+func WithSourceVerification() Option {
+	return func(c *config) error {
+		c.server.verifySource = true
+
+		return nil
+	}
 }
 
+// NewServerConnection relays packets between peers on the PacketConn, using
+// the store to look up their addresses. Other packets, such as those of the
+// relay's HTTP/3 server, are returned by ReadFrom. The HTTP/3 server must use
+// StandardQUICConfig, or StandardQUICConfigWithConnectionIDLength with the
+// same connection ID length as the options of
+// NewServerConnectionWithOptions.
 func NewServerConnection(ctx context.Context, pconn net.PacketConn, store Store) ServerConnection {
-	return &serverConn{
-		ctx:   ctx,
-		pconn: pconn,
-		store: store,
+	// fails only with options
+	conn, _ := newServerConn(ctx, pconn, store)
+
+	return conn
+}
+
+// NewServerConnectionWithOptions is like NewServerConnection, configured by
+// the options.
+func NewServerConnectionWithOptions(ctx context.Context, pconn net.PacketConn, store Store, options ...Option) (ServerConnection, error) {
+	return newServerConn(ctx, pconn, store, options...)
+}
+
+func newServerConn(ctx context.Context, pconn net.PacketConn, store Store, options ...Option) (*serverConn, error) {
+	cfg := &config{}
+
+	for _, option := range options {
+		if err := option(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	cidlen := cfg.cidlen
+	if cidlen == 0 {
+		cidlen = StandardQUICConnectionIDLength
 	}
+
+	var sources AddrStore
+
+	if cfg.server.verifySource {
+		addrStore, ok := store.(AddrStore)
+		if !ok {
+			return nil, ErrSourceVerificationStore
+		}
+
+		sources = addrStore
+	}
+
+	return &serverConn{
+		ctx:     ctx,
+		pconn:   pconn,
+		store:   store,
+		cidlen:  cidlen,
+		metrics: cfg.server.metrics,
+
+		accounting: cfg.server.accounting,
+
+		sourceLimit:      cfg.server.sourceLimit,
+		destinationLimit: cfg.server.destinationLimit,
+
+		sources: sources,
+
+		registerMu: &sync.Mutex{},
+	}, nil
 }
@@ -0,0 +1,165 @@
+package quicpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// plainStore hides the ConditionalStore methods of its Store.
+type plainStore struct {
+	Store
+}
+
+func testStores(t *testing.T) map[string]Store {
+	fileStore, err := OpenFileStore(filepath.Join(t.TempDir(), "store.log"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { fileStore.Close() })
+
+	return map[string]Store{
+		"MapStore":     NewMapStore(),
+		"ShardedStore": NewShardedStore(),
+		"FileStore":    fileStore,
+		"Store":        plainStore{NewMapStore()},
+	}
+}
+
+func newTestServerConn(t *testing.T, store Store) *serverConn {
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { pconn.Close() })
+
+	conn, err := newServerConn(context.Background(), pconn, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestServerConnRegisterOwner(t *testing.T) {
+	ctx := context.Background()
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			conn := newTestServerConn(t, store)
+
+			register := func(key string, owner string) error {
+				return conn.RegisterWith(ctx, Registration{
+					Key:   []byte(key),
+					Num:   3,
+					Addr:  addr,
+					Owner: owner,
+				})
+			}
+
+			if err := conn.Refresh(ctx, Registration{Key: []byte("a"), Num: 3, Addr: addr, Owner: "a"}); !errors.Is(err, ErrAssociationNotFound) {
+				t.Fatalf("expected refreshing an unknown key to fail, got %v", err)
+			}
+
+			if err := register("a", "a"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := register("a", "a"); err != nil {
+				t.Fatalf("expected the owner to register again, got %v", err)
+			}
+
+			if err := register("a", "b"); !errors.Is(err, ErrAssociationOwner) {
+				t.Fatalf("expected %v, got %v", ErrAssociationOwner, err)
+			}
+
+			// b owns a CID derived from a key it does not know
+			generator := conn.generator([]byte("b"))
+			generator.GenerateConnectionIDBytes()
+
+			cid, err := generator.GenerateConnectionIDBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.PutAssociation(ctx, Association{ConnectionIDs: [][]byte{cid}, Addr: addr, Owner: "b"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := register("b", "c"); !errors.Is(err, ErrAssociationOwner) {
+				t.Fatalf("expected the second CID's owner to be checked, got %v", err)
+			}
+
+			if err := register("b", "b"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestServerConnRegisterRace(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			conn := newTestServerConn(t, store)
+
+			var (
+				wg        sync.WaitGroup
+				mu        sync.Mutex
+				succeeded []string
+			)
+
+			for i := 0; i < 16; i += 1 {
+				owner := fmt.Sprint(i)
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					err := conn.RegisterWith(ctx, Registration{
+						Key:   []byte("key"),
+						Num:   4,
+						Addr:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433},
+						Owner: owner,
+					})
+					if err == nil {
+						mu.Lock()
+						succeeded = append(succeeded, owner)
+						mu.Unlock()
+					} else if !errors.Is(err, ErrAssociationOwner) {
+						t.Error(err)
+					}
+				}()
+			}
+
+			wg.Wait()
+
+			if len(succeeded) != 1 {
+				t.Fatalf("expected exactly one owner to register the key, got %v", succeeded)
+			}
+
+			cid, err := conn.firstConnectionID([]byte("key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			association, err := store.GetAssociation(ctx, cid)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if association.Owner != succeeded[0] {
+				t.Fatalf("expected the association of %s, got %s's", succeeded[0], association.Owner)
+			}
+		})
+	}
+}
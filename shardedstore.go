@@ -0,0 +1,442 @@
+package quicpipe
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardedStoreShards is the number of independently locked shards.
+const shardedStoreShards = 64
+
+// cidKey is a connection ID usable as a map key without allocating.
+type cidKey struct {
+	len uint8
+	cid [MaxQUICConnectionIDLength]byte
+}
+
+func newCIDKey(cid []byte) (cidKey, bool) {
+	var key cidKey
+
+	if len(cid) > len(key.cid) {
+		return key, false
+	}
+
+	key.len = uint8(len(cid))
+	copy(key.cid[:], cid)
+
+	return key, true
+}
+
+// shard hashes the CID with FNV-1a.
+func (k *cidKey) shard() int {
+	h := uint32(2166136261)
+
+	for i := 0; i < int(k.len); i += 1 {
+		h ^= uint32(k.cid[i])
+		h *= 16777619
+	}
+
+	return int(h % shardedStoreShards)
+}
+
+// shardedStoreEntry uses the atomic types, which are aligned for 64-bit
+// operations on 32-bit platforms too.
+type shardedStoreEntry struct {
+	association Association
+
+	// refs is the number of CIDs pointing to the entry
+	refs atomic.Int32
+
+	// seen is the time of the last lookup in Unix nanoseconds
+	seen atomic.Int64
+
+	xdpSeen atomic.Uint64
+}
+
+func (e *shardedStoreEntry) expired(now time.Time) bool {
+	return e.association.TTL > 0 && now.UnixNano()-e.seen.Load() > int64(e.association.TTL)
+}
+
+type storeShard struct {
+	sync.RWMutex
+
+	entries map[cidKey]*shardedStoreEntry
+}
+
+// shardedStorePeerKey identifies a peer added to the XDP filter.
+type shardedStorePeerKey struct {
+	addr    string
+	session uint64
+}
+
+type shardedStorePeer struct {
+	peer xdpPeer
+
+	// refs is the number of associations with the peer
+	refs int
+}
+
+// ShardedStore is a Store like MapStore, for high packet rates. Its CIDs are
+// spread over shards with their own read-write locks, and looking them up
+// does not allocate. It does not implement AddrStore or SessionStore.
+type ShardedStore struct {
+	shards [shardedStoreShards]storeShard
+	count  atomic.Int64
+
+	// peers counts the associations of each peer added to an XDP filter
+	// verifying sources, so that the peer is removed with the last one
+	peersMu sync.Mutex
+	peers   map[shardedStorePeerKey]*shardedStorePeer
+
+	XDP XDPRedirector
+
+	// Metrics, if not nil, receives the number of associations.
+	Metrics Metrics
+}
+
+func NewShardedStore() *ShardedStore {
+	s := &ShardedStore{
+		peers: make(map[shardedStorePeerKey]*shardedStorePeer),
+	}
+
+	for i := range s.shards {
+		s.shards[i].entries = make(map[cidKey]*shardedStoreEntry)
+	}
+
+	return s
+}
+
+func (s *ShardedStore) shard(key *cidKey) *storeShard {
+	return &s.shards[key.shard()]
+}
+
+func (s *ShardedStore) PutAssociation(ctx context.Context, association Association) error {
+	return s.PutAssociationIf(ctx, association, nil)
+}
+
+// PutAssociationIf implements ConditionalStore. A nil check always passes.
+// The shards of the association's CIDs stay locked while it is checked and
+// put.
+func (s *ShardedStore) PutAssociationIf(ctx context.Context, association Association, check func(replaced []Association) error) error {
+	keys := make([]cidKey, 0, len(association.ConnectionIDs))
+
+	var locked [shardedStoreShards]bool
+
+	for _, cid := range association.ConnectionIDs {
+		key, ok := newCIDKey(cid)
+		if !ok {
+			return ErrConnectionIDLength
+		}
+
+		keys = append(keys, key)
+		locked[key.shard()] = true
+	}
+
+	// in order, so that concurrent puts don't deadlock
+	for i := range locked {
+		if locked[i] {
+			s.shards[i].Lock()
+		}
+	}
+
+	released, err := s.put(association, keys, check)
+
+	for i := range locked {
+		if locked[i] {
+			s.shards[i].Unlock()
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.report()
+
+	if err := removePeers(s.XDP, s.releasePeers(released)); err != nil {
+		return err
+	}
+
+	return addRedirects(s.XDP, association)
+}
+
+// put checks and puts the association, returning the replaced entries that
+// no CID points to anymore. Must be called with the shards of the keys
+// locked.
+func (s *ShardedStore) put(association Association, keys []cidKey, check func(replaced []Association) error) ([]*shardedStoreEntry, error) {
+	if check != nil {
+		var replaced []Association
+
+		seen := make(map[*shardedStoreEntry]bool)
+
+		for i := range keys {
+			old, ok := s.shard(&keys[i]).entries[keys[i]]
+			if ok && !seen[old] {
+				replaced = append(replaced, old.association)
+			}
+
+			seen[old] = true
+		}
+
+		if err := check(replaced); err != nil {
+			return nil, err
+		}
+	}
+
+	entry := &shardedStoreEntry{
+		association: association,
+	}
+
+	entry.seen.Store(time.Now().UnixNano())
+
+	if len(keys) > 0 {
+		// before releasing replaced entries, to keep their peers
+		s.acquirePeers(entry)
+	}
+
+	var released []*shardedStoreEntry
+
+	for i := range keys {
+		shard := s.shard(&keys[i])
+
+		old, ok := shard.entries[keys[i]]
+		if ok && old == entry {
+			continue
+		}
+
+		shard.entries[keys[i]] = entry
+		entry.refs.Add(1)
+
+		if ok && s.release(old) {
+			released = append(released, old)
+		}
+	}
+
+	if entry.refs.Load() > 0 {
+		s.count.Add(1)
+	}
+
+	return released, nil
+}
+
+func (s *ShardedStore) GetAssociation(ctx context.Context, cid []byte) (Association, error) {
+	key, ok := newCIDKey(cid)
+	if !ok {
+		return Association{}, ErrAssociationNotFound
+	}
+
+	shard := s.shard(&key)
+
+	shard.RLock()
+	entry, ok := shard.entries[key]
+	shard.RUnlock()
+
+	if !ok {
+		return Association{}, ErrAssociationNotFound
+	}
+
+	// packets are flowing
+	entry.seen.Store(time.Now().UnixNano())
+
+	return entry.association, nil
+}
+
+func (s *ShardedStore) DeleteAssociation(ctx context.Context, cid []byte) error {
+	key, ok := newCIDKey(cid)
+	if !ok {
+		return ErrAssociationNotFound
+	}
+
+	shard := s.shard(&key)
+
+	shard.RLock()
+	entry, ok := shard.entries[key]
+	shard.RUnlock()
+
+	if !ok {
+		return ErrAssociationNotFound
+	}
+
+	removed, gone := s.remove(entry)
+
+	s.report()
+
+	if err := removePeers(s.XDP, gone); err != nil {
+		return err
+	}
+
+	return removeRedirects(s.XDP, entry.association.Addr, removed...)
+}
+
+// remove removes all CIDs that still point to the entry, returning them and
+// the peers to remove from the XDP filter.
+func (s *ShardedStore) remove(entry *shardedStoreEntry) ([][]byte, []xdpPeer) {
+	removed := make([][]byte, 0, len(entry.association.ConnectionIDs))
+
+	for _, cid := range entry.association.ConnectionIDs {
+		key, _ := newCIDKey(cid)
+		shard := s.shard(&key)
+
+		shard.Lock()
+		// a later PutAssociation may have taken over this CID
+		ok := shard.entries[key] == entry
+		if ok {
+			delete(shard.entries, key)
+		}
+		shard.Unlock()
+
+		if ok {
+			removed = append(removed, cid)
+
+			if s.release(entry) {
+				// no CID points to the entry anymore
+				return removed, s.releasePeers([]*shardedStoreEntry{entry})
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// release drops a reference to the entry, returning true once there are none
+// left.
+func (s *ShardedStore) release(entry *shardedStoreEntry) bool {
+	if entry.refs.Add(-1) > 0 {
+		return false
+	}
+
+	s.count.Add(-1)
+
+	return true
+}
+
+// acquirePeers counts the peers of the entry, if the XDP filter verifies
+// sources.
+func (s *ShardedStore) acquirePeers(entry *shardedStoreEntry) {
+	if _, ok := s.XDP.(XDPSourceVerifier); !ok {
+		return
+	}
+
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	for _, peer := range xdpPeers(entry.association) {
+		key := shardedStorePeerKey{addr: peer.addr.String(), session: peer.session}
+
+		counted, ok := s.peers[key]
+		if !ok {
+			counted = &shardedStorePeer{peer: peer}
+			s.peers[key] = counted
+		}
+
+		counted.refs += 1
+	}
+}
+
+// releasePeers drops the peers of released entries, returning the peers no
+// other entry has.
+func (s *ShardedStore) releasePeers(entries []*shardedStoreEntry) []xdpPeer {
+	if _, ok := s.XDP.(XDPSourceVerifier); !ok || len(entries) == 0 {
+		return nil
+	}
+
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	var gone []xdpPeer
+
+	for _, entry := range entries {
+		for _, peer := range xdpPeers(entry.association) {
+			key := shardedStorePeerKey{addr: peer.addr.String(), session: peer.session}
+
+			counted, ok := s.peers[key]
+			if !ok {
+				continue
+			}
+
+			counted.refs -= 1
+
+			if counted.refs == 0 {
+				delete(s.peers, key)
+				gone = append(gone, counted.peer)
+			}
+		}
+	}
+
+	return gone
+}
+
+func (s *ShardedStore) report() {
+	if s.Metrics != nil {
+		s.Metrics.Set(MetricAssociations, s.count.Load())
+	}
+}
+
+// Len returns the number of associations with at least one CID.
+func (s *ShardedStore) Len() int {
+	return int(s.count.Load())
+}
+
+// Expire is like MapStore.Expire.
+func (s *ShardedStore) Expire(ctx context.Context, now time.Time) error {
+	idle := make(map[*shardedStoreEntry]bool)
+
+	for i := range s.shards {
+		shard := &s.shards[i]
+
+		shard.RLock()
+		for _, entry := range shard.entries {
+			if entry.expired(now) {
+				idle[entry] = true
+			}
+		}
+		shard.RUnlock()
+	}
+
+	var firstErr error
+
+	for entry := range idle {
+		if s.XDP != nil {
+			xdpSeen, err := s.XDP.LastRedirect(entry.association.ConnectionIDs...)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+
+				continue
+			}
+
+			if xdpSeen > entry.xdpSeen.Load() {
+				// packets are flowing through the XDP filter
+				entry.xdpSeen.Store(xdpSeen)
+				entry.seen.Store(now.UnixNano())
+			}
+		}
+
+		// GetAssociation may have refreshed the entry in the meantime
+		if !entry.expired(now) {
+			continue
+		}
+
+		removed, gone := s.remove(entry)
+
+		if err := removePeers(s.XDP, gone); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		if err := removeRedirects(s.XDP, entry.association.Addr, removed...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	s.report()
+
+	return firstErr
+}
+
+// Sweep is like MapStore.Sweep.
+func (s *ShardedStore) Sweep(ctx context.Context, interval time.Duration, onError func(err error)) error {
+	return sweep(ctx, interval, s.Expire, onError)
+}
@@ -0,0 +1,282 @@
+package quicpipe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const benchmarkAssociations = 1024
+
+// benchmarkStore looks up CIDs from parallel goroutines, putting one
+// association for every 64 lookups, as when peers register while packets
+// are flowing.
+func benchmarkStore(b *testing.B, store Store) {
+	ctx := context.Background()
+
+	cids := make([][]byte, 0, 4*benchmarkAssociations)
+
+	for i := 0; i < benchmarkAssociations; i += 1 {
+		association := Association{
+			Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: i},
+		}
+
+		for j := 0; j < 4; j += 1 {
+			cid := make([]byte, 8)
+			binary.BigEndian.PutUint32(cid, uint32(i))
+			binary.BigEndian.PutUint32(cid[4:], uint32(j))
+
+			association.ConnectionIDs = append(association.ConnectionIDs, cid)
+		}
+
+		if err := store.PutAssociation(ctx, association); err != nil {
+			b.Fatal(err)
+		}
+
+		cids = append(cids, association.ConnectionIDs...)
+	}
+
+	var seed uint32
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&seed, 7919))
+
+		for pb.Next() {
+			i += 1
+
+			if i%64 == 0 {
+				n := i / 4 % benchmarkAssociations
+
+				if err := store.PutAssociation(ctx, Association{
+					ConnectionIDs: cids[4*n : 4*n+4],
+					Addr:          &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: n},
+				}); err != nil {
+					b.Error(err)
+					return
+				}
+
+				continue
+			}
+
+			if _, err := store.GetAssociation(ctx, cids[i%len(cids)]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkShardedStore(b *testing.B) {
+	benchmarkStore(b, NewShardedStore())
+}
+
+func BenchmarkMapStore(b *testing.B) {
+	benchmarkStore(b, NewMapStore())
+}
+
+func TestShardedStore(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewShardedStore()
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+
+	if _, err := store.GetAssociation(ctx, []byte{1}); !errors.Is(err, ErrAssociationNotFound) {
+		t.Fatalf("expected no association, got %v", err)
+	}
+
+	association := Association{
+		ConnectionIDs: [][]byte{{1}, {2}},
+		Addr:          addr,
+		Session:       "s",
+		Owner:         "owner",
+	}
+
+	if err := store.PutAssociation(ctx, association); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cid := range association.ConnectionIDs {
+		got, err := store.GetAssociation(ctx, cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Addr != addr || got.Session != "s" || got.Owner != "owner" || len(got.ConnectionIDs) != 2 {
+			t.Fatalf("unexpected association %+v", got)
+		}
+	}
+
+	if store.Len() != 1 {
+		t.Fatalf("expected 1 association, got %d", store.Len())
+	}
+
+	if err := store.PutAssociation(ctx, Association{ConnectionIDs: [][]byte{make([]byte, MaxQUICConnectionIDLength+1)}}); !errors.Is(err, ErrConnectionIDLength) {
+		t.Fatalf("expected a too long CID to be rejected, got %v", err)
+	}
+
+	// deleting by any CID removes all of them
+	if err := store.DeleteAssociation(ctx, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cid := range association.ConnectionIDs {
+		if _, err := store.GetAssociation(ctx, cid); !errors.Is(err, ErrAssociationNotFound) {
+			t.Fatalf("expected deleted association, got %v", err)
+		}
+	}
+
+	if err := store.DeleteAssociation(ctx, []byte{1}); !errors.Is(err, ErrAssociationNotFound) {
+		t.Fatalf("expected no association, got %v", err)
+	}
+
+	if store.Len() != 0 {
+		t.Fatalf("expected no associations, got %d", store.Len())
+	}
+}
+
+func TestShardedStoreTakeover(t *testing.T) {
+	ctx := context.Background()
+
+	xdp := newFakeXDP()
+
+	store := NewShardedStore()
+	store.XDP = xdp
+
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2}
+
+	if err := store.PutAssociation(ctx, Association{ConnectionIDs: [][]byte{{1}, {2}}, Addr: first}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutAssociation(ctx, Association{ConnectionIDs: [][]byte{{2}, {3}}, Addr: second}); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Len() != 2 {
+		t.Fatalf("expected 2 associations, got %d", store.Len())
+	}
+
+	for cid, addr := range map[byte]*net.UDPAddr{1: first, 2: second, 3: second} {
+		association, err := store.GetAssociation(ctx, []byte{cid})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if association.Addr != addr {
+			t.Fatalf("expected CID %d at %v, got %v", cid, addr, association.Addr)
+		}
+	}
+
+	// deleting the first association keeps the CID taken over
+	if err := store.DeleteAssociation(ctx, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetAssociation(ctx, []byte{2}); err != nil {
+		t.Fatalf("expected the taken over CID to be kept, got %v", err)
+	}
+
+	if redirected := xdp.redirected(); len(redirected) != 2 || !redirected["02"] || !redirected["03"] {
+		t.Fatalf("expected redirects of the second association, got %v", redirected)
+	}
+
+	// taking over all CIDs releases the association
+	if err := store.PutAssociation(ctx, Association{ConnectionIDs: [][]byte{{2}, {3}}, Addr: first}); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Len() != 1 {
+		t.Fatalf("expected 1 association, got %d", store.Len())
+	}
+}
+
+func TestShardedStoreExpire(t *testing.T) {
+	ctx := context.Background()
+
+	xdp := newFakeXDP()
+
+	store := NewShardedStore()
+	store.XDP = xdp
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+
+	for _, association := range []Association{
+		{ConnectionIDs: [][]byte{{1}}, Addr: addr, TTL: time.Minute},
+		{ConnectionIDs: [][]byte{{2}}, Addr: addr, TTL: time.Minute},
+		{ConnectionIDs: [][]byte{{3}}, Addr: addr, TTL: time.Hour},
+		{ConnectionIDs: [][]byte{{4}}, Addr: addr},
+	} {
+		if err := store.PutAssociation(ctx, association); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// packets redirected by the XDP filter keep the second one
+	xdp.last["02"] = 1
+
+	if err := store.Expire(ctx, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetAssociation(ctx, []byte{1}); !errors.Is(err, ErrAssociationNotFound) {
+		t.Fatalf("expected the idle association to expire, got %v", err)
+	}
+
+	for _, cid := range []byte{2, 3, 4} {
+		if _, err := store.GetAssociation(ctx, []byte{cid}); err != nil {
+			t.Fatalf("expected association %d to be kept, got %v", cid, err)
+		}
+	}
+
+	if redirected := xdp.redirected(); redirected["01"] || len(redirected) != 3 {
+		t.Fatalf("expected the expired redirect to be removed, got %v", redirected)
+	}
+
+	if store.Len() != 3 {
+		t.Fatalf("expected 3 associations, got %d", store.Len())
+	}
+}
+
+func TestShardedStorePeers(t *testing.T) {
+	xdp := newFakeVerifier()
+
+	store := NewShardedStore()
+	store.XDP = xdp
+
+	testStorePeers(t, store, xdp)
+}
+
+func TestShardedStoreGetAllocs(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewShardedStore()
+
+	cid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	if err := store.PutAssociation(ctx, Association{
+		ConnectionIDs: [][]byte{cid},
+		Addr:          &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		store.GetAssociation(ctx, cid)
+		store.GetAssociation(ctx, missing)
+	})
+
+	if allocs != 0 {
+		t.Fatalf("expected lookups not to allocate, got %v allocations", allocs)
+	}
+}
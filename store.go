@@ -0,0 +1,784 @@
+package quicpipe
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAssociationTTL = 10 * time.Minute
+)
+
+type Association struct {
+	ConnectionIDs [][]byte
+	Addr          net.Addr
+
+	// TTL is how long the association is kept after packets stop flowing
+	// through it. Zero means it never expires.
+	TTL time.Duration
+
+	// Quota limits the traffic forwarded to the association, when the relay
+	// uses Accounting.
+	Quota Quota
+
+	// Session pairs the association with the other peer's, usually the
+	// dialer's with the accepter's. Paired associations are unregistered
+	// together and share their quota. With source verification, only
+	// packets from the addresses of associations with the same session are
+	// forwarded to it. Empty if unpaired.
+	Session string
+
+	// Owner identifies the peer which registered the association. Only
+	// the same owner may register over, refresh or unregister it through
+	// ServerConnection.
+	Owner string
+}
+
+var ErrAssociationNotFound = errors.New("quicpipe: association for this connection ID does not exist")
+
+type Store interface {
+	PutAssociation(ctx context.Context, association Association) error
+	GetAssociation(ctx context.Context, cid []byte) (Association, error)
+	DeleteAssociation(ctx context.Context, cid []byte) error
+}
+
+// AddrStore is a Store which can look up associations by address, as needed
+// for source verification.
+type AddrStore interface {
+	Store
+
+	// GetAssociationsByAddr returns the associations with the address,
+	// which is not considered activity. It returns no error if there are
+	// none.
+	GetAssociationsByAddr(ctx context.Context, addr net.Addr) ([]Association, error)
+}
+
+// SessionStore is a Store which can look up and remove associations by
+// session.
+type SessionStore interface {
+	Store
+
+	// GetSession returns the associations of the session, which is not
+	// considered activity. It returns no error if there are none.
+	GetSession(ctx context.Context, session string) ([]Association, error)
+
+	// DeleteSession removes all associations of the session, or returns
+	// ErrAssociationNotFound if there are none.
+	DeleteSession(ctx context.Context, session string) error
+}
+
+// ConditionalStore is a Store which can check the associations a put replaces
+// in the same operation. ServerConnection needs it to let only the owner of
+// an association register over it, even when registrations race on several
+// relays sharing the store.
+type ConditionalStore interface {
+	Store
+
+	// PutAssociationIf calls check with the associations holding any of
+	// the association's CIDs, and only puts the association if check
+	// returns nil. Otherwise it returns check's error. check must not use
+	// the store.
+	PutAssociationIf(ctx context.Context, association Association, check func(replaced []Association) error) error
+}
+
+// XDPRedirector is implemented by the eBPF XDP filter in the xdp package.
+type XDPRedirector interface {
+	AddIPv4Redirect(addr *net.UDPAddr, cids ...[]byte) error
+	RemoveIPv4Redirect(cids ...[]byte) error
+	AddIPv6Redirect(addr *net.UDPAddr, cids ...[]byte) error
+	RemoveIPv6Redirect(cids ...[]byte) error
+
+	// LastRedirect returns an opaque monotonic timestamp of the last packet
+	// redirected for any of the CIDs, or 0 if there never was one.
+	LastRedirect(cids ...[]byte) (uint64, error)
+}
+
+// XDPSourceVerifier is implemented by the eBPF XDP filter in the xdp package.
+// Sessions are identified by sessionID.
+type XDPSourceVerifier interface {
+	AddIPv4RedirectSession(addr *net.UDPAddr, session uint64, cids ...[]byte) error
+	AddIPv6RedirectSession(addr *net.UDPAddr, session uint64, cids ...[]byte) error
+
+	// AddPeer allows packets from the address to redirects of the
+	// session, or to redirects without a session if it is 0.
+	AddPeer(addr *net.UDPAddr, session uint64) error
+	RemovePeer(addr *net.UDPAddr, session uint64) error
+}
+
+// xdpIPv4Redirector is the least MapStore needs of an XDP filter. The other
+// methods of XDPRedirector and XDPSourceVerifier are used if it has them.
+type xdpIPv4Redirector interface {
+	AddIPv4Redirect(addr *net.UDPAddr, cids ...[]byte) error
+}
+
+// sessionID hashes a session for the XDP filter, 0 meaning none.
+func sessionID(session string) uint64 {
+	if session == "" {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(session))
+
+	if id := h.Sum64(); id != 0 {
+		return id
+	}
+
+	return 1
+}
+
+// addRedirects adds redirects for the association's CIDs to the IPv4 or IPv6
+// map, if it has a UDP address. If the filter verifies sources, the address is
+// added as a peer too.
+func addRedirects(xdp xdpIPv4Redirector, association Association) error {
+	udpAddr, ok := association.Addr.(*net.UDPAddr)
+	if !ok || xdp == nil || len(association.ConnectionIDs) == 0 {
+		return nil
+	}
+
+	cids := association.ConnectionIDs
+
+	verifier, ok := xdp.(XDPSourceVerifier)
+	if !ok {
+		if udpAddr.IP.To4() != nil {
+			return xdp.AddIPv4Redirect(udpAddr, cids...)
+		}
+
+		if redirector, ok := xdp.(XDPRedirector); ok {
+			return redirector.AddIPv6Redirect(udpAddr, cids...)
+		}
+
+		return nil
+	}
+
+	for _, peer := range xdpPeers(association) {
+		if err := verifier.AddPeer(peer.addr, peer.session); err != nil {
+			return err
+		}
+	}
+
+	session := sessionID(association.Session)
+
+	if udpAddr.IP.To4() != nil {
+		return verifier.AddIPv4RedirectSession(udpAddr, session, cids...)
+	}
+
+	return verifier.AddIPv6RedirectSession(udpAddr, session, cids...)
+}
+
+// removeRedirects removes the redirects added by addRedirects.
+func removeRedirects(xdp xdpIPv4Redirector, addr net.Addr, cids ...[]byte) error {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || len(cids) == 0 {
+		return nil
+	}
+
+	redirector, ok := xdp.(XDPRedirector)
+	if !ok {
+		return nil
+	}
+
+	if udpAddr.IP.To4() != nil {
+		return redirector.RemoveIPv4Redirect(cids...)
+	}
+
+	return redirector.RemoveIPv6Redirect(cids...)
+}
+
+// xdpPeer is a peer added by addRedirects.
+type xdpPeer struct {
+	addr    *net.UDPAddr
+	session uint64
+}
+
+// xdpPeers returns the peers addRedirects adds for the association: its
+// address for session 0, and for its own session if it has one.
+func xdpPeers(association Association) []xdpPeer {
+	udpAddr, ok := association.Addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	peers := []xdpPeer{{addr: udpAddr}}
+
+	if session := sessionID(association.Session); session != 0 {
+		peers = append(peers, xdpPeer{addr: udpAddr, session: session})
+	}
+
+	return peers
+}
+
+// removePeers removes peers from the filter, if it verifies sources.
+func removePeers(xdp xdpIPv4Redirector, peers []xdpPeer) error {
+	verifier, ok := xdp.(XDPSourceVerifier)
+	if !ok {
+		return nil
+	}
+
+	var firstErr error
+
+	for _, peer := range peers {
+		if err := verifier.RemovePeer(peer.addr, peer.session); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+type mapStoreEntry struct {
+	association Association
+
+	// refs is the number of CIDs pointing to the entry
+	refs int
+
+	// seq orders the entries by when they were put
+	seq uint64
+
+	seen    time.Time
+	xdpSeen uint64
+}
+
+func (e *mapStoreEntry) expired(now time.Time) bool {
+	return e.association.TTL > 0 && now.Sub(e.seen) > e.association.TTL
+}
+
+type MapStore struct {
+	sync.Mutex
+
+	entries map[string]*mapStoreEntry
+	count   int
+	seq     uint64
+
+	// addrs and sessions index the entries
+	addrs    map[string]mapStoreEntries
+	sessions map[string]mapStoreEntries
+
+	// Map holds the address of each hex-encoded CID, and is kept in sync
+	// with the associations. Addresses put into it directly never expire.
+	Map map[string]net.Addr
+
+	// XDP, if not nil, receives the redirects of the associations. Removing
+	// them, IPv6, expiry and source verification need the methods of
+	// XDPRedirector and XDPSourceVerifier.
+	XDP interface {
+		AddIPv4Redirect(addr *net.UDPAddr, cids ...[]byte) error
+	}
+
+	// Metrics, if not nil, receives the number of associations and
+	// sessions.
+	Metrics Metrics
+}
+
+type mapStoreEntries map[*mapStoreEntry]struct{}
+
+func (e mapStoreEntries) associations() []Association {
+	associations := make([]Association, 0, len(e))
+
+	for entry := range e {
+		associations = append(associations, entry.association)
+	}
+
+	return associations
+}
+
+func NewMapStore() *MapStore {
+	return &MapStore{
+		entries:  make(map[string]*mapStoreEntry),
+		addrs:    make(map[string]mapStoreEntries),
+		sessions: make(map[string]mapStoreEntries),
+		Map:      make(map[string]net.Addr),
+	}
+}
+
+func (m *MapStore) PutAssociation(ctx context.Context, association Association) error {
+	return m.PutAssociationIf(ctx, association, nil)
+}
+
+// PutAssociationIf implements ConditionalStore. A nil check always passes.
+func (m *MapStore) PutAssociationIf(ctx context.Context, association Association, check func(replaced []Association) error) error {
+	var gone []xdpPeer
+
+	err := func() error {
+		m.Lock()
+		defer m.Unlock()
+
+		if check != nil {
+			if err := check(m.replaced(association.ConnectionIDs)); err != nil {
+				return err
+			}
+		}
+
+		m.seq += 1
+
+		entry := &mapStoreEntry{
+			association: association,
+			seq:         m.seq,
+			seen:        time.Now(),
+		}
+
+		if len(association.ConnectionIDs) > 0 {
+			// before releasing replaced entries, to keep their peers
+			m.index(entry)
+		}
+
+		for _, cid := range association.ConnectionIDs {
+			s := hex.EncodeToString(cid)
+
+			if old, ok := m.entries[s]; ok {
+				if old == entry {
+					continue
+				}
+
+				gone = append(gone, m.release(old)...)
+			}
+
+			m.entries[s] = entry
+			m.Map[s] = association.Addr
+			entry.refs += 1
+		}
+
+		if entry.refs > 0 {
+			m.count += 1
+		}
+
+		m.report()
+
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := removePeers(m.XDP, gone); err != nil {
+		return err
+	}
+
+	return addRedirects(m.XDP, association)
+}
+
+func (m *MapStore) GetAssociation(ctx context.Context, cid []byte) (Association, error) {
+	s := hex.EncodeToString(cid)
+
+	m.Lock()
+	defer m.Unlock()
+
+	entry, ok := m.entries[s]
+	if ok {
+		// packets are flowing
+		entry.seen = time.Now()
+
+		return entry.association, nil
+	}
+
+	if addr, ok := m.Map[s]; ok {
+		return Association{
+			Addr: addr,
+		}, nil
+	}
+
+	return Association{}, ErrAssociationNotFound
+}
+
+func (m *MapStore) GetAssociationsByAddr(ctx context.Context, addr net.Addr) ([]Association, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.addrs[addr.String()].associations(), nil
+}
+
+func (m *MapStore) GetSession(ctx context.Context, session string) ([]Association, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.sessions[session].associations(), nil
+}
+
+// replaced returns the associations holding any of the CIDs. Must be called
+// with the lock held.
+func (m *MapStore) replaced(cids [][]byte) []Association {
+	var associations []Association
+
+	seen := make(map[*mapStoreEntry]bool)
+
+	for _, cid := range cids {
+		entry, ok := m.entries[hex.EncodeToString(cid)]
+		if ok && !seen[entry] {
+			associations = append(associations, entry.association)
+		}
+
+		seen[entry] = true
+	}
+
+	return associations
+}
+
+// owned returns all associations with at least one CID in the order they
+// were put, each with only the CIDs it still holds, so that putting them
+// again restores the store.
+func (m *MapStore) owned() []Association {
+	m.Lock()
+	defer m.Unlock()
+
+	seen := make(map[*mapStoreEntry]bool)
+	entries := make([]*mapStoreEntry, 0, m.count)
+
+	for _, entry := range m.entries {
+		if !seen[entry] {
+			entries = append(entries, entry)
+		}
+
+		seen[entry] = true
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	associations := make([]Association, 0, len(entries))
+
+	for _, entry := range entries {
+		association := entry.association
+
+		if entry.refs < len(association.ConnectionIDs) {
+			// later puts took over some of the CIDs
+			cids := make([][]byte, 0, entry.refs)
+
+			for _, cid := range association.ConnectionIDs {
+				if m.entries[hex.EncodeToString(cid)] == entry {
+					cids = append(cids, cid)
+				}
+			}
+
+			association.ConnectionIDs = cids
+		}
+
+		associations = append(associations, association)
+	}
+
+	return associations
+}
+
+// RangeSessions calls fn with the associations of each session.
+func (m *MapStore) RangeSessions(fn func(session string, associations []Association)) {
+	m.Lock()
+	sessions := make(map[string][]Association, len(m.sessions))
+
+	for session, entries := range m.sessions {
+		sessions[session] = entries.associations()
+	}
+	m.Unlock()
+
+	for session, associations := range sessions {
+		fn(session, associations)
+	}
+}
+
+func (m *MapStore) DeleteAssociation(ctx context.Context, cid []byte) error {
+	s := hex.EncodeToString(cid)
+
+	var (
+		addr    net.Addr
+		removed [][]byte
+		gone    []xdpPeer
+	)
+
+	err := func() error {
+		m.Lock()
+		defer m.Unlock()
+
+		entry, ok := m.entries[s]
+		if !ok {
+			if _, ok := m.Map[s]; ok {
+				delete(m.Map, s)
+				return nil
+			}
+
+			return ErrAssociationNotFound
+		}
+
+		addr = entry.association.Addr
+		removed, gone = m.remove(entry)
+
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := removePeers(m.XDP, gone); err != nil {
+		return err
+	}
+
+	return removeRedirects(m.XDP, addr, removed...)
+}
+
+func (m *MapStore) DeleteSession(ctx context.Context, session string) error {
+	type removal struct {
+		addr    net.Addr
+		removed [][]byte
+	}
+
+	var (
+		removals []removal
+		gone     []xdpPeer
+	)
+
+	func() {
+		m.Lock()
+		defer m.Unlock()
+
+		for entry := range m.sessions[session] {
+			removed, peers := m.remove(entry)
+
+			removals = append(removals, removal{
+				addr:    entry.association.Addr,
+				removed: removed,
+			})
+			gone = append(gone, peers...)
+		}
+	}()
+
+	if len(removals) == 0 {
+		return ErrAssociationNotFound
+	}
+
+	firstErr := removePeers(m.XDP, gone)
+
+	for _, removal := range removals {
+		if err := removeRedirects(m.XDP, removal.addr, removal.removed...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// remove removes all CIDs that still point to the entry, returning them and
+// the peers to remove from the XDP filter. Must be called with the lock held.
+func (m *MapStore) remove(entry *mapStoreEntry) ([][]byte, []xdpPeer) {
+	removed := make([][]byte, 0, len(entry.association.ConnectionIDs))
+
+	var gone []xdpPeer
+
+	for _, cid := range entry.association.ConnectionIDs {
+		s := hex.EncodeToString(cid)
+
+		// a later PutAssociation may have taken over this CID
+		if m.entries[s] == entry {
+			delete(m.entries, s)
+			delete(m.Map, s)
+			removed = append(removed, cid)
+
+			gone = append(gone, m.release(entry)...)
+		}
+	}
+
+	m.report()
+
+	return removed, gone
+}
+
+// release drops a CID's reference to the entry, returning the peers to
+// remove from the XDP filter once there are none left. Must be called with the
+// lock held.
+func (m *MapStore) release(entry *mapStoreEntry) []xdpPeer {
+	entry.refs -= 1
+
+	if entry.refs > 0 {
+		return nil
+	}
+
+	m.count -= 1
+
+	return m.unindex(entry)
+}
+
+func indexEntry(index map[string]mapStoreEntries, key string, entry *mapStoreEntry) {
+	entries, ok := index[key]
+	if !ok {
+		entries = make(mapStoreEntries)
+		index[key] = entries
+	}
+
+	entries[entry] = struct{}{}
+}
+
+func unindexEntry(index map[string]mapStoreEntries, key string, entry *mapStoreEntry) mapStoreEntries {
+	entries := index[key]
+	delete(entries, entry)
+
+	if len(entries) == 0 {
+		delete(index, key)
+	}
+
+	return entries
+}
+
+// index adds the entry to the address and session indexes. Must be called
+// with the lock held.
+func (m *MapStore) index(entry *mapStoreEntry) {
+	if entry.association.Session != "" {
+		indexEntry(m.sessions, entry.association.Session, entry)
+	}
+
+	if entry.association.Addr != nil {
+		indexEntry(m.addrs, entry.association.Addr.String(), entry)
+	}
+}
+
+// unindex removes the entry from the indexes, returning the peers no other
+// entry with the address needs. Must be called with the lock held.
+func (m *MapStore) unindex(entry *mapStoreEntry) []xdpPeer {
+	if entry.association.Session != "" {
+		unindexEntry(m.sessions, entry.association.Session, entry)
+	}
+
+	if entry.association.Addr == nil {
+		return nil
+	}
+
+	entries := unindexEntry(m.addrs, entry.association.Addr.String(), entry)
+
+	udpAddr, ok := entry.association.Addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	var gone []xdpPeer
+
+	if len(entries) == 0 {
+		gone = append(gone, xdpPeer{addr: udpAddr})
+	}
+
+	session := sessionID(entry.association.Session)
+	if session == 0 {
+		return gone
+	}
+
+	for other := range entries {
+		if other.association.Session == entry.association.Session {
+			return gone
+		}
+	}
+
+	return append(gone, xdpPeer{addr: udpAddr, session: session})
+}
+
+// report sets the associations and sessions gauges. Must be called with the
+// lock held.
+func (m *MapStore) report() {
+	if m.Metrics != nil {
+		m.Metrics.Set(MetricAssociations, int64(m.count))
+		m.Metrics.Set(MetricSessions, int64(len(m.sessions)))
+	}
+}
+
+// Len returns the number of associations with at least one CID.
+func (m *MapStore) Len() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.count
+}
+
+// Expire removes all associations that have been idle for longer than their
+// TTL, together with their XDP redirects. Packets redirected by the XDP
+// filter count as activity.
+func (m *MapStore) Expire(ctx context.Context, now time.Time) error {
+	var idle []*mapStoreEntry
+
+	func() {
+		m.Lock()
+		defer m.Unlock()
+
+		seen := make(map[*mapStoreEntry]bool)
+
+		for _, entry := range m.entries {
+			if !seen[entry] && entry.expired(now) {
+				idle = append(idle, entry)
+			}
+
+			seen[entry] = true
+		}
+	}()
+
+	var firstErr error
+
+	redirector, _ := m.XDP.(XDPRedirector)
+
+	for _, entry := range idle {
+		if redirector != nil {
+			xdpSeen, err := redirector.LastRedirect(entry.association.ConnectionIDs...)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+
+				continue
+			}
+
+			m.Lock()
+			if xdpSeen > entry.xdpSeen {
+				// packets are flowing through the XDP filter
+				entry.xdpSeen = xdpSeen
+				entry.seen = now
+			}
+			m.Unlock()
+		}
+
+		var (
+			removed [][]byte
+			gone    []xdpPeer
+		)
+
+		func() {
+			m.Lock()
+			defer m.Unlock()
+
+			// GetAssociation may have refreshed the entry in the meantime
+			if entry.expired(now) {
+				removed, gone = m.remove(entry)
+			}
+		}()
+
+		if err := removePeers(m.XDP, gone); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		if err := removeRedirects(m.XDP, entry.association.Addr, removed...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Sweep calls Expire every interval until the context is done. Errors from
+// Expire are passed to onError, which may be nil.
+func (m *MapStore) Sweep(ctx context.Context, interval time.Duration, onError func(err error)) error {
+	return sweep(ctx, interval, m.Expire, onError)
+}
+
+func sweep(ctx context.Context, interval time.Duration, expire func(ctx context.Context, now time.Time) error, onError func(err error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case now := <-ticker.C:
+			if err := expire(ctx, now); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,541 @@
+package quicpipe
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeXDP is an XDPRedirector keeping the redirects in memory.
+type fakeXDP struct {
+	mu        sync.Mutex
+	redirects map[string]*net.UDPAddr
+
+	// last is returned by LastRedirect for a CID, err instead if set
+	last map[string]uint64
+	err  error
+}
+
+func newFakeXDP() *fakeXDP {
+	return &fakeXDP{
+		redirects: make(map[string]*net.UDPAddr),
+		last:      make(map[string]uint64),
+	}
+}
+
+func (x *fakeXDP) add(addr *net.UDPAddr, cids [][]byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, cid := range cids {
+		x.redirects[hex.EncodeToString(cid)] = addr
+	}
+
+	return nil
+}
+
+func (x *fakeXDP) remove(cids [][]byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, cid := range cids {
+		delete(x.redirects, hex.EncodeToString(cid))
+	}
+
+	return nil
+}
+
+func (x *fakeXDP) AddIPv4Redirect(addr *net.UDPAddr, cids ...[]byte) error {
+	return x.add(addr, cids)
+}
+
+func (x *fakeXDP) RemoveIPv4Redirect(cids ...[]byte) error {
+	return x.remove(cids)
+}
+
+func (x *fakeXDP) AddIPv6Redirect(addr *net.UDPAddr, cids ...[]byte) error {
+	return x.add(addr, cids)
+}
+
+func (x *fakeXDP) RemoveIPv6Redirect(cids ...[]byte) error {
+	return x.remove(cids)
+}
+
+func (x *fakeXDP) LastRedirect(cids ...[]byte) (uint64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.err != nil {
+		return 0, x.err
+	}
+
+	var last uint64
+	for _, cid := range cids {
+		if t := x.last[hex.EncodeToString(cid)]; t > last {
+			last = t
+		}
+	}
+
+	return last, nil
+}
+
+// redirected returns the hex-encoded CIDs with a redirect.
+func (x *fakeXDP) redirected() map[string]bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	cids := make(map[string]bool, len(x.redirects))
+	for cid := range x.redirects {
+		cids[cid] = true
+	}
+
+	return cids
+}
+
+// fakeVerifier is a fakeXDP which verifies sources, keeping its peers in
+// memory.
+type fakeVerifier struct {
+	*fakeXDP
+
+	peers map[string]bool
+}
+
+func newFakeVerifier() *fakeVerifier {
+	return &fakeVerifier{
+		fakeXDP: newFakeXDP(),
+		peers:   make(map[string]bool),
+	}
+}
+
+func peerString(addr *net.UDPAddr, session uint64) string {
+	return fmt.Sprintf("%v/%d", addr, session)
+}
+
+func (x *fakeVerifier) AddIPv4RedirectSession(addr *net.UDPAddr, session uint64, cids ...[]byte) error {
+	return x.add(addr, cids)
+}
+
+func (x *fakeVerifier) AddIPv6RedirectSession(addr *net.UDPAddr, session uint64, cids ...[]byte) error {
+	return x.add(addr, cids)
+}
+
+func (x *fakeVerifier) AddPeer(addr *net.UDPAddr, session uint64) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.peers[peerString(addr, session)] = true
+
+	return nil
+}
+
+func (x *fakeVerifier) RemovePeer(addr *net.UDPAddr, session uint64) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.peers, peerString(addr, session))
+
+	return nil
+}
+
+// expectPeers fails unless the filter has exactly the peers.
+func (x *fakeVerifier) expectPeers(t *testing.T, peers ...string) {
+	t.Helper()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if len(x.peers) != len(peers) {
+		t.Fatalf("expected peers %v, got %v", peers, x.peers)
+	}
+
+	for _, peer := range peers {
+		if !x.peers[peer] {
+			t.Fatalf("expected peers %v, got %v", peers, x.peers)
+		}
+	}
+}
+
+// testStorePeers checks that the store removes peers from the filter with
+// their last association, when it is deleted, expires or is taken over.
+func testStorePeers(t *testing.T, store interface {
+	Store
+	Expire(ctx context.Context, now time.Time) error
+}, xdp *fakeVerifier) {
+	ctx := context.Background()
+
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2}
+	idle := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 3}
+
+	session := sessionID("s")
+
+	put := func(association Association) {
+		t.Helper()
+
+		if err := store.PutAssociation(ctx, association); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put(Association{ConnectionIDs: [][]byte{{1}}, Addr: first, Session: "s"})
+	put(Association{ConnectionIDs: [][]byte{{2}}, Addr: first})
+
+	xdp.expectPeers(t, peerString(first, 0), peerString(first, session))
+
+	// taking over the first association removes its session's peer, but
+	// the address is still a peer of the second one
+	put(Association{ConnectionIDs: [][]byte{{1}}, Addr: second, Session: "s"})
+
+	xdp.expectPeers(t, peerString(first, 0), peerString(second, 0), peerString(second, session))
+
+	if err := store.DeleteAssociation(ctx, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	xdp.expectPeers(t, peerString(second, 0), peerString(second, session))
+
+	put(Association{ConnectionIDs: [][]byte{{3}}, Addr: idle, TTL: time.Minute})
+
+	xdp.expectPeers(t, peerString(second, 0), peerString(second, session), peerString(idle, 0))
+
+	if err := store.Expire(ctx, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	xdp.expectPeers(t, peerString(second, 0), peerString(second, session))
+
+	// re-registering keeps the peers
+	put(Association{ConnectionIDs: [][]byte{{1}}, Addr: second, Session: "s"})
+
+	xdp.expectPeers(t, peerString(second, 0), peerString(second, session))
+
+	if err := store.DeleteAssociation(ctx, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	xdp.expectPeers(t)
+}
+
+func TestMapStorePeers(t *testing.T) {
+	xdp := newFakeVerifier()
+
+	store := NewMapStore()
+	store.XDP = xdp
+
+	testStorePeers(t, store, xdp)
+}
+
+// ipv4Redirector only has the method MapStore.XDP used to require.
+type ipv4Redirector struct {
+	cids [][]byte
+}
+
+func (r *ipv4Redirector) AddIPv4Redirect(addr *net.UDPAddr, cids ...[]byte) error {
+	r.cids = append(r.cids, cids...)
+	return nil
+}
+
+func TestMapStoreMap(t *testing.T) {
+	ctx := context.Background()
+
+	xdp := &ipv4Redirector{}
+
+	store := NewMapStore()
+	store.XDP = xdp
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+
+	if err := store.PutAssociation(ctx, Association{
+		ConnectionIDs: [][]byte{{1, 2, 3, 4}},
+		Addr:          addr,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(xdp.cids) != 1 {
+		t.Fatalf("expected one redirect, got %d", len(xdp.cids))
+	}
+
+	if store.Map["01020304"] != addr {
+		t.Fatalf("association is not in Map: %v", store.Map)
+	}
+
+	if err := store.DeleteAssociation(ctx, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.Map["01020304"]; ok {
+		t.Fatal("deleted association is still in Map")
+	}
+
+	// put directly, as before associations had TTLs
+	store.Map["05060708"] = addr
+
+	association, err := store.GetAssociation(ctx, []byte{5, 6, 7, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if association.Addr != addr {
+		t.Fatalf("expected %v, got %v", addr, association.Addr)
+	}
+
+	if err := store.DeleteAssociation(ctx, []byte{5, 6, 7, 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetAssociation(ctx, []byte{5, 6, 7, 8}); !errors.Is(err, ErrAssociationNotFound) {
+		t.Fatalf("expected ErrAssociationNotFound, got %v", err)
+	}
+}
+
+func TestMapStoreExpire(t *testing.T) {
+	errLastRedirect := errors.New("last redirect failed")
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+	addr6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4433}
+
+	tests := []struct {
+		name string
+
+		associations []Association
+
+		// after is the time since the associations were put
+		after time.Duration
+
+		// last and err are reported by the XDP filter
+		last map[string]uint64
+		err  error
+
+		// remaining CIDs in the store and the XDP filter
+		remaining []string
+	}{
+		{
+			name: "idle",
+			associations: []Association{
+				{ConnectionIDs: [][]byte{{1}, {2}}, Addr: addr, TTL: time.Minute},
+			},
+			after: 2 * time.Minute,
+		},
+		{
+			name: "idle IPv6",
+			associations: []Association{
+				{ConnectionIDs: [][]byte{{1}, {2}}, Addr: addr6, TTL: time.Minute},
+			},
+			after: 2 * time.Minute,
+		},
+		{
+			name: "within TTL",
+			associations: []Association{
+				{ConnectionIDs: [][]byte{{1}, {2}}, Addr: addr, TTL: time.Minute},
+			},
+			after:     30 * time.Second,
+			remaining: []string{"01", "02"},
+		},
+		{
+			name: "no TTL",
+			associations: []Association{
+				{ConnectionIDs: [][]byte{{1}}, Addr: addr},
+			},
+			after:     time.Hour,
+			remaining: []string{"01"},
+		},
+		{
+			name: "redirected by XDP",
+			associations: []Association{
+				{ConnectionIDs: [][]byte{{1}, {2}}, Addr: addr, TTL: time.Minute},
+			},
+			after:     2 * time.Minute,
+			last:      map[string]uint64{"02": 1},
+			remaining: []string{"01", "02"},
+		},
+		{
+			name: "XDP error",
+			associations: []Association{
+				{ConnectionIDs: [][]byte{{1}}, Addr: addr, TTL: time.Minute},
+			},
+			after:     2 * time.Minute,
+			err:       errLastRedirect,
+			remaining: []string{"01"},
+		},
+		{
+			name: "taken over",
+			associations: []Association{
+				{ConnectionIDs: [][]byte{{1}, {2}}, Addr: addr, TTL: time.Minute},
+				{ConnectionIDs: [][]byte{{2}, {3}}, Addr: addr6},
+			},
+			after:     2 * time.Minute,
+			remaining: []string{"02", "03"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			xdp := newFakeXDP()
+
+			store := NewMapStore()
+			store.XDP = xdp
+
+			for _, association := range test.associations {
+				if err := store.PutAssociation(ctx, association); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for cid, last := range test.last {
+				xdp.last[cid] = last
+			}
+			xdp.err = test.err
+
+			if err := store.Expire(ctx, time.Now().Add(test.after)); !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			redirected := xdp.redirected()
+			if len(redirected) != len(test.remaining) {
+				t.Fatalf("expected redirects for %v, got %v", test.remaining, redirected)
+			}
+
+			for _, s := range test.remaining {
+				cid, _ := hex.DecodeString(s)
+
+				if _, err := store.GetAssociation(ctx, cid); err != nil {
+					t.Fatalf("expected %s to remain: %v", s, err)
+				}
+
+				if !redirected[s] {
+					t.Fatalf("expected a redirect for %s", s)
+				}
+			}
+
+			if n := len(store.entries); n != len(test.remaining) {
+				t.Fatalf("expected %d CIDs, got %d", len(test.remaining), n)
+			}
+		})
+	}
+}
+
+func TestMapStoreExpireRedirected(t *testing.T) {
+	ctx := context.Background()
+
+	xdp := newFakeXDP()
+
+	store := NewMapStore()
+	store.XDP = xdp
+
+	if err := store.PutAssociation(ctx, Association{
+		ConnectionIDs: [][]byte{{1}},
+		Addr:          &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433},
+		TTL:           time.Minute,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	xdp.last["01"] = 1
+
+	// the redirect counts as activity once
+	if err := store.Expire(ctx, now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Expire(ctx, now.Add(3*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Len() != 1 {
+		t.Fatal("expected the association to be kept within TTL of the redirect")
+	}
+
+	if err := store.Expire(ctx, now.Add(4*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Len() != 0 || len(xdp.redirected()) != 0 {
+		t.Fatal("expected the association to expire without further redirects")
+	}
+}
+
+func TestMapStoreSweep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	xdp := newFakeXDP()
+
+	store := NewMapStore()
+	store.XDP = xdp
+
+	for i := byte(0); i < 2; i += 1 {
+		if err := store.PutAssociation(ctx, Association{
+			ConnectionIDs: [][]byte{{i}},
+			Addr:          &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433},
+			TTL:           time.Duration(i) * time.Nanosecond,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error)
+	go func() { done <- store.Sweep(ctx, time.Millisecond, nil) }()
+
+	for deadline := time.Now().Add(time.Second); store.Len() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected Sweep to expire the association")
+		}
+	}
+
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	if redirected := xdp.redirected(); len(redirected) != 1 || !redirected["00"] {
+		t.Fatalf("expected only the redirect without TTL, got %v", redirected)
+	}
+}
+
+func TestMapStoreSweepError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	xdp := newFakeXDP()
+	xdp.err = errors.New("last redirect failed")
+
+	store := NewMapStore()
+	store.XDP = xdp
+
+	if err := store.PutAssociation(ctx, Association{
+		ConnectionIDs: [][]byte{{1}},
+		Addr:          &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433},
+		TTL:           time.Nanosecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+
+	go store.Sweep(ctx, time.Millisecond, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, xdp.err) {
+			t.Fatalf("expected %v, got %v", xdp.err, err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("expected Sweep to report the error")
+	}
+}
@@ -0,0 +1,229 @@
+// Package token implements HMAC-signed registration tokens for Quicpipe
+// relays.
+//
+// Tokens are minted by an application backend which shares a secret with the
+// relay. They authorize the bearer to register a limited number of connection
+// IDs until they expire, optionally only for a specific connection ID key or
+// session. The token's peer owns the associations it registers, so peers
+// cannot take over each other's connection IDs.
+package token
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hf/quicpipe"
+	"github.com/hf/quicpipe/relayhttp"
+)
+
+// Claims are the contents of a token.
+type Claims struct {
+	// Peer identifies the peer the token was issued to, and owns the
+	// associations it registers. It must not be empty.
+	Peer string
+
+	// Key, if set, is the only connection ID key the peer may register.
+	Key []byte
+
+	// Session, if set, is the only session the peer may join. Binding
+	// tokens to sessions keeps others from pairing with the peer.
+	Session string
+
+	// MaxConnectionIDs is the maximum number of connection IDs the peer may
+	// register.
+	MaxConnectionIDs int
+
+	// ExpiresAt is the time after which the token is no longer valid.
+	ExpiresAt time.Time
+}
+
+type wireClaims struct {
+	Peer    string `json:"peer"`
+	Key     []byte `json:"key,omitempty"`
+	Session string `json:"session,omitempty"`
+	Num     int    `json:"num"`
+	Exp     int64  `json:"exp"`
+}
+
+// Error is a token verification error. The code is sent by the relay to the
+// client, so it can be recognized with errors.Is on the client side.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "quicpipe/token: " + e.Message
+}
+
+// ErrorCode returns the error's code.
+func (e *Error) ErrorCode() string {
+	return e.Code
+}
+
+var (
+	ErrMissing              = &Error{Code: "token_missing", Message: "token is missing"}
+	ErrPeerMissing          = &Error{Code: "token_peer_missing", Message: "token was not issued to a peer"}
+	ErrMalformed            = &Error{Code: "token_malformed", Message: "token is malformed"}
+	ErrSignature            = &Error{Code: "token_signature", Message: "token signature is invalid"}
+	ErrExpired              = &Error{Code: "token_expired", Message: "token has expired"}
+	ErrTooManyConnectionIDs = &Error{Code: "token_too_many_connection_ids", Message: "token does not allow this many connection IDs"}
+	ErrKeyMismatch          = &Error{Code: "token_key_mismatch", Message: "token was not issued for this connection ID key"}
+	ErrSessionMismatch      = &Error{Code: "token_session_mismatch", Message: "token was not issued for this session"}
+)
+
+var encoding = base64.RawURLEncoding
+
+func sign(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
+
+// Sign mints a token with the provided claims.
+func Sign(secret []byte, claims Claims) (string, error) {
+	data, err := json.Marshal(wireClaims{
+		Peer:    claims.Peer,
+		Key:     claims.Key,
+		Session: claims.Session,
+		Num:     claims.MaxConnectionIDs,
+		Exp:     claims.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := encoding.EncodeToString(data)
+
+	return payload + "." + encoding.EncodeToString(sign(secret, payload)), nil
+}
+
+// Verify checks the token's signature and expiry, returning its claims.
+func Verify(secret []byte, token string, now time.Time) (Claims, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Claims{}, ErrMalformed
+	}
+
+	mac, err := encoding.DecodeString(signature)
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+
+	if !hmac.Equal(mac, sign(secret, payload)) {
+		return Claims{}, ErrSignature
+	}
+
+	data, err := encoding.DecodeString(payload)
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+
+	var wc wireClaims
+	if err := json.Unmarshal(data, &wc); err != nil {
+		return Claims{}, ErrMalformed
+	}
+
+	claims := Claims{
+		Peer:             wc.Peer,
+		Key:              wc.Key,
+		Session:          wc.Session,
+		MaxConnectionIDs: wc.Num,
+		ExpiresAt:        time.Unix(wc.Exp, 0),
+	}
+
+	if !now.Before(claims.ExpiresAt) {
+		return Claims{}, ErrExpired
+	}
+
+	return claims, nil
+}
+
+// Authorize checks that the claims allow the registration request.
+func (c Claims) Authorize(req relayhttp.Request) error {
+	if c.Peer == "" {
+		return ErrPeerMissing
+	}
+
+	if req.Num > c.MaxConnectionIDs {
+		return ErrTooManyConnectionIDs
+	}
+
+	if len(c.Key) > 0 && !bytes.Equal(c.Key, req.Key) {
+		return ErrKeyMismatch
+	}
+
+	if c.Session != "" && c.Session != req.Session {
+		return ErrSessionMismatch
+	}
+
+	return nil
+}
+
+// FromRequest returns the bearer token from the Authorization header.
+func FromRequest(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", ErrMissing
+	}
+
+	return token, nil
+}
+
+func verifyRequest(secret []byte, r *http.Request) (Claims, error) {
+	token, err := FromRequest(r)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	return Verify(secret, token, time.Now())
+}
+
+// Authorizer returns a relayhttp.Authorizer which only allows requests
+// carrying a valid token signed with the secret.
+func Authorizer(secret []byte) relayhttp.Authorizer {
+	return func(r *http.Request, req relayhttp.Request) error {
+		claims, err := verifyRequest(secret, r)
+		if err != nil {
+			return err
+		}
+
+		return claims.Authorize(req)
+	}
+}
+
+// Identifier returns a relayhttp.Identifier which identifies requests by
+// the peer of their token.
+func Identifier(secret []byte) relayhttp.Identifier {
+	return func(r *http.Request) (string, error) {
+		claims, err := verifyRequest(secret, r)
+		if err != nil {
+			return "", err
+		}
+
+		if claims.Peer == "" {
+			return "", ErrPeerMissing
+		}
+
+		return claims.Peer, nil
+	}
+}
+
+// NewHandler creates a relayhttp.Handler for the connection which only
+// allows requests carrying a valid token signed with the secret, and
+// identifies them by the peer of the token.
+func NewHandler(conn quicpipe.ServerConnection, secret []byte) *relayhttp.Handler {
+	handler := relayhttp.NewHandler(conn, Authorizer(secret))
+	handler.Identify = Identifier(secret)
+
+	return handler
+}
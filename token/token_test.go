@@ -0,0 +1,165 @@
+package token
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hf/quicpipe/relayhttp"
+)
+
+var secret = []byte("secret")
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	claims := Claims{
+		Peer:             "peer",
+		Key:              []byte{1, 2, 3},
+		Session:          "session",
+		MaxConnectionIDs: 10,
+		ExpiresAt:        now.Add(time.Hour),
+	}
+
+	valid, err := Sign(secret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := Sign(secret, Claims{
+		Peer:             "peer",
+		MaxConnectionIDs: 10,
+		ExpiresAt:        now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, signature, _ := strings.Cut(valid, ".")
+
+	tests := []struct {
+		name   string
+		secret []byte
+		token  string
+		err    error
+	}{
+		{"valid", secret, valid, nil},
+		{"expired", secret, expired, ErrExpired},
+		{"wrong secret", []byte("other"), valid, ErrSignature},
+		{"bad mac", secret, payload + "." + encoding.EncodeToString(make([]byte, 32)), ErrSignature},
+		{"tampered payload", secret, encoding.EncodeToString([]byte(`{"peer":"other","num":64,"exp":9999999999}`)) + "." + signature, ErrSignature},
+		{"no signature", secret, payload, ErrMalformed},
+		{"signature not base64", secret, payload + ".!", ErrMalformed},
+		{"payload not json", secret, "bm90IGpzb24." + encoding.EncodeToString(sign(secret, "bm90IGpzb24")), ErrMalformed},
+		{"empty", secret, "", ErrMalformed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Verify(test.secret, test.token, now)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if got.Peer != claims.Peer || string(got.Key) != string(claims.Key) || got.Session != claims.Session || got.MaxConnectionIDs != claims.MaxConnectionIDs || !got.ExpiresAt.Equal(claims.ExpiresAt) {
+				t.Fatalf("expected claims %+v, got %+v", claims, got)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims Claims
+		req    relayhttp.Request
+		err    error
+	}{
+		{
+			name:   "allowed",
+			claims: Claims{Peer: "peer", MaxConnectionIDs: 10},
+			req:    relayhttp.Request{Key: []byte{1}, Num: 10},
+		},
+		{
+			name:   "no peer",
+			claims: Claims{MaxConnectionIDs: 10},
+			req:    relayhttp.Request{Key: []byte{1}, Num: 1},
+			err:    ErrPeerMissing,
+		},
+		{
+			name:   "too many connection IDs",
+			claims: Claims{Peer: "peer", MaxConnectionIDs: 10},
+			req:    relayhttp.Request{Key: []byte{1}, Num: 11},
+			err:    ErrTooManyConnectionIDs,
+		},
+		{
+			name:   "key",
+			claims: Claims{Peer: "peer", Key: []byte{1}, MaxConnectionIDs: 10},
+			req:    relayhttp.Request{Key: []byte{1}, Num: 1},
+		},
+		{
+			name:   "key mismatch",
+			claims: Claims{Peer: "peer", Key: []byte{1}, MaxConnectionIDs: 10},
+			req:    relayhttp.Request{Key: []byte{2}, Num: 1},
+			err:    ErrKeyMismatch,
+		},
+		{
+			name:   "key mismatch when unregistering",
+			claims: Claims{Peer: "peer", Key: []byte{1}},
+			req:    relayhttp.Request{Key: []byte{2}},
+			err:    ErrKeyMismatch,
+		},
+		{
+			name:   "session",
+			claims: Claims{Peer: "peer", Session: "a", MaxConnectionIDs: 10},
+			req:    relayhttp.Request{Key: []byte{1}, Num: 1, Session: "a"},
+		},
+		{
+			name:   "session mismatch",
+			claims: Claims{Peer: "peer", Session: "a", MaxConnectionIDs: 10},
+			req:    relayhttp.Request{Key: []byte{1}, Num: 1, Session: "b"},
+			err:    ErrSessionMismatch,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.claims.Authorize(test.req); !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		err    error
+	}{
+		{"Bearer abc", "abc", nil},
+		{"bearer abc", "abc", nil},
+		{"", "", ErrMissing},
+		{"Bearer", "", ErrMissing},
+		{"Bearer ", "", ErrMissing},
+		{"Basic abc", "", ErrMissing},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", relayhttp.RegisterPath, nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+
+		token, err := FromRequest(r)
+		if token != test.token || !errors.Is(err, test.err) {
+			t.Errorf("%q: expected %q, %v, got %q, %v", test.header, test.token, test.err, token, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package xdp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+)
+
+// DefaultTTL is the IPv4 TTL and IPv6 hop limit of redirected packets.
+const DefaultTTL = 64
+
+var (
+	// ErrMapEntries is returned by Open for map sizes over MaxMapEntries.
+	ErrMapEntries = errors.New("quicpipe/xdp: too many map entries")
+
+	// ErrRingBufferSize is returned by Open for ring buffer sizes which are
+	// not a power of two multiple of the page size.
+	ErrRingBufferSize = errors.New("quicpipe/xdp: ring buffer size must be a power of two multiple of the page size")
+)
+
+// MaxMapEntries is the most entries Options allows in a map.
+const MaxMapEntries = 64 * 1024 * 1024
+
+// Options configure the eBPF filter before it is loaded. Zero values keep the
+// defaults of xdp.c. Maps pinned with other sizes can't be reused by
+// OpenPinned.
+type Options struct {
+	// Redirect4Entries is the size of the IPv4 redirect LRU map, 2m by
+	// default at about 44 bytes per entry.
+	Redirect4Entries uint32
+
+	// Redirect6Entries is the size of the IPv6 redirect LRU map, 1m by
+	// default at about 60 bytes per entry.
+	Redirect6Entries uint32
+
+	// PeerEntries is the size of the source verification peer map, 1m by
+	// default.
+	PeerEntries uint32
+
+	// PortEntries is the number of ports that can be attached, 32 by
+	// default.
+	PortEntries uint32
+
+	// SourceLimitEntries is the size of the source rate limit LRU map, 256k
+	// by default.
+	SourceLimitEntries uint32
+
+	// UsageEntries is the size of the per-CID usage LRU map, 256k by
+	// default.
+	UsageEntries uint32
+
+	// RejectedCIDsSize is the size of the rejected CID ring buffer in bytes,
+	// 64kB by default.
+	RejectedCIDsSize uint32
+
+	// CIDLength is the CID length used by AttachPort, DefaultCIDLength by
+	// default.
+	CIDLength int
+
+	// TTL is the IPv4 TTL and IPv6 hop limit of redirected packets,
+	// DefaultTTL by default.
+	TTL uint8
+}
+
+func (o *Options) validate() error {
+	entries := []uint32{
+		o.Redirect4Entries,
+		o.Redirect6Entries,
+		o.PeerEntries,
+		o.PortEntries,
+		o.SourceLimitEntries,
+		o.UsageEntries,
+	}
+
+	for _, n := range entries {
+		if n > MaxMapEntries {
+			return ErrMapEntries
+		}
+	}
+
+	if size := o.RejectedCIDsSize; size != 0 {
+		if size&(size-1) != 0 || size%uint32(os.Getpagesize()) != 0 {
+			return ErrRingBufferSize
+		}
+	}
+
+	if o.CIDLength != 0 && (o.CIDLength < MinCIDLength || o.CIDLength > MaxCIDLength) {
+		return ErrCIDLength
+	}
+
+	return nil
+}
+
+// apply rewrites the map sizes and constants of the spec.
+func (o *Options) apply(spec *ebpf.CollectionSpec) error {
+	sizes := map[string]uint32{
+		"redirect4_map":    o.Redirect4Entries,
+		"redirect6_map":    o.Redirect6Entries,
+		"peer_map":         o.PeerEntries,
+		"port_map":         o.PortEntries,
+		"source_limit_map": o.SourceLimitEntries,
+		"usage_map":        o.UsageEntries,
+		"rejected_cids_rb": o.RejectedCIDsSize,
+	}
+
+	for name, size := range sizes {
+		if size == 0 {
+			continue
+		}
+
+		m, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("quicpipe/xdp: map %s is missing from the eBPF object", name)
+		}
+
+		m.MaxEntries = size
+	}
+
+	if o.TTL != 0 {
+		return spec.RewriteConstants(map[string]interface{}{
+			"redirect_ttl": o.TTL,
+		})
+	}
+
+	return nil
+}
+
+func (o *Options) cidLength() int {
+	if o.CIDLength == 0 {
+		return DefaultCIDLength
+	}
+
+	return o.CIDLength
+}
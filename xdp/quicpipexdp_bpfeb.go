@@ -13,12 +13,58 @@ import (
 	"github.com/cilium/ebpf"
 )
 
-type quicpipexdpCid struct{ Cid [12]uint8 }
+type quicpipexdpCid struct{ Cid [20]uint8 }
+
+type quicpipexdpPeer struct {
+	Addr    [16]uint8
+	Port    uint16
+	Pad     [6]uint8
+	Session uint64
+}
 
 type quicpipexdpRedirect4 struct {
-	Addr uint32
-	Port uint16
-	_    [2]byte
+	Addr    uint32
+	Port    uint16
+	_       [2]byte
+	Seen    uint64
+	Session uint64
+}
+
+type quicpipexdpRedirect6 struct {
+	Addr    [16]uint8
+	Port    uint16
+	_       [6]byte
+	Seen    uint64
+	Session uint64
+}
+
+type quicpipexdpSource struct{ Addr [16]uint8 }
+
+type quicpipexdpSourceLimit struct {
+	Tokens uint64
+	Last   uint64
+}
+
+type quicpipexdpSourceLimitConfig struct {
+	Rate  uint64
+	Burst uint64
+}
+
+type quicpipexdpStats struct {
+	Redirected      uint64
+	RedirectedBytes uint64
+	Passed          uint64
+	Dropped         uint64
+	Rejected        uint64
+	Limited         uint64
+	Spoofed         uint64
+}
+
+type quicpipexdpUsage struct {
+	Packets uint64
+	Bytes   uint64
+	CidLen  uint32
+	_       [4]byte
 }
 
 // loadQuicpipexdp returns the embedded CollectionSpec for quicpipexdp.
@@ -69,9 +115,16 @@ type quicpipexdpProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type quicpipexdpMapSpecs struct {
-	PortMap        *ebpf.MapSpec `ebpf:"port_map"`
-	Redirect4Map   *ebpf.MapSpec `ebpf:"redirect4_map"`
-	RejectedCidsRb *ebpf.MapSpec `ebpf:"rejected_cids_rb"`
+	PeerMap               *ebpf.MapSpec `ebpf:"peer_map"`
+	PortMap               *ebpf.MapSpec `ebpf:"port_map"`
+	Redirect4Map          *ebpf.MapSpec `ebpf:"redirect4_map"`
+	Redirect6Map          *ebpf.MapSpec `ebpf:"redirect6_map"`
+	RejectedCidsRb        *ebpf.MapSpec `ebpf:"rejected_cids_rb"`
+	SourceLimitConfigMap  *ebpf.MapSpec `ebpf:"source_limit_config_map"`
+	SourceLimitMap        *ebpf.MapSpec `ebpf:"source_limit_map"`
+	SourceVerificationMap *ebpf.MapSpec `ebpf:"source_verification_map"`
+	StatsMap              *ebpf.MapSpec `ebpf:"stats_map"`
+	UsageMap              *ebpf.MapSpec `ebpf:"usage_map"`
 }
 
 // quicpipexdpObjects contains all objects after they have been loaded into the kernel.
@@ -93,16 +146,30 @@ func (o *quicpipexdpObjects) Close() error {
 //
 // It can be passed to loadQuicpipexdpObjects or ebpf.CollectionSpec.LoadAndAssign.
 type quicpipexdpMaps struct {
-	PortMap        *ebpf.Map `ebpf:"port_map"`
-	Redirect4Map   *ebpf.Map `ebpf:"redirect4_map"`
-	RejectedCidsRb *ebpf.Map `ebpf:"rejected_cids_rb"`
+	PeerMap               *ebpf.Map `ebpf:"peer_map"`
+	PortMap               *ebpf.Map `ebpf:"port_map"`
+	Redirect4Map          *ebpf.Map `ebpf:"redirect4_map"`
+	Redirect6Map          *ebpf.Map `ebpf:"redirect6_map"`
+	RejectedCidsRb        *ebpf.Map `ebpf:"rejected_cids_rb"`
+	SourceLimitConfigMap  *ebpf.Map `ebpf:"source_limit_config_map"`
+	SourceLimitMap        *ebpf.Map `ebpf:"source_limit_map"`
+	SourceVerificationMap *ebpf.Map `ebpf:"source_verification_map"`
+	StatsMap              *ebpf.Map `ebpf:"stats_map"`
+	UsageMap              *ebpf.Map `ebpf:"usage_map"`
 }
 
 func (m *quicpipexdpMaps) Close() error {
 	return _QuicpipexdpClose(
+		m.PeerMap,
 		m.PortMap,
 		m.Redirect4Map,
+		m.Redirect6Map,
 		m.RejectedCidsRb,
+		m.SourceLimitConfigMap,
+		m.SourceLimitMap,
+		m.SourceVerificationMap,
+		m.StatsMap,
+		m.UsageMap,
 	)
 }
 
@@ -3,6 +3,7 @@
 #include <linux/bpf.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
 #include <linux/types.h>
 #include <linux/udp.h>
 
@@ -11,37 +12,163 @@
 
 char __license[] SEC("license") = "Dual MIT/GPL";
 
+#define MIN_CID_LEN 4
+#define MAX_CID_LEN 20
+
+// rewritten by Options.TTL before loading
+volatile const __u8 redirect_ttl = 64;
+
+// CIDs shorter than MAX_CID_LEN are padded with zeroes
 struct cid
 {
-  __u8 cid[12];
+  __u8 cid[MAX_CID_LEN];
+};
+
+struct rejected_cid
+{
+  __u8 len;
+  __u8 cid[MAX_CID_LEN];
 };
 
 struct redirect4
 {
   __be32 addr;
   __be16 port;
+  __u64 seen;    // bpf_ktime_get_ns() of the last redirected packet
+  __u64 session; // peers allowed to send to the redirect, 0 for any
+};
+
+struct redirect6
+{
+  __u8 addr[16];
+  __be16 port;
+  __u64 seen;    // bpf_ktime_get_ns() of the last redirected packet
+  __u64 session; // peers allowed to send to the redirect, 0 for any
+};
+
+struct stats
+{
+  __u64 redirected;       // packets sent back out of the NIC
+  __u64 redirected_bytes; // UDP payload bytes of redirected packets
+  __u64 passed;           // packets passed to the network stack
+  __u64 dropped;          // packets dropped, including rejected ones
+  __u64 rejected;         // packets without a redirect for their CID
+  __u64 limited;          // packets dropped by the source rate limit
+  __u64 spoofed;          // packets dropped by source verification
+};
+
+struct
+{
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, struct stats);
+} stats_map SEC(".maps");
+
+#define NSEC_PER_SEC 1000000000ULL
+
+struct source_limit_config
+{
+  __u64 rate;  // packets per second, 0 disables the limit
+  __u64 burst; // packets
+};
+
+struct
+{
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, struct source_limit_config);
+} source_limit_config_map SEC(".maps");
+
+// IPv4 sources are stored as IPv4-mapped IPv6 addresses
+struct source
+{
+  __u8 addr[16];
+};
+
+struct source_limit
+{
+  __u64 tokens; // in packets * NSEC_PER_SEC
+  __u64 last;   // bpf_ktime_get_ns() of the last refill
+};
+
+struct
+{
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 256 * 1024);
+  __type(key, struct source);
+  __type(value, struct source_limit);
+} source_limit_map SEC(".maps");
+
+struct
+{
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, __u32); // non-zero if enabled
+} source_verification_map SEC(".maps");
+
+// peers are added for session 0 and for their own session, if any
+struct peer
+{
+  __u8 addr[16]; // same as struct source
+  __be16 port;
+  __u8 pad[6];
+  __u64 session;
 };
 
+struct
+{
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 1024 * 1024);
+  __type(key, struct peer);
+  __type(value, __u8);
+} peer_map SEC(".maps");
+
 struct
 {
   __uint(type, BPF_MAP_TYPE_HASH);
   __uint(max_entries, 32);
   __type(key, __be16);
-  __type(value, __u8);
+  __type(value, __u8); // CID length
 } port_map SEC(".maps");
 
 struct
 {
   __uint(type, BPF_MAP_TYPE_LRU_HASH);
-  __uint(max_entries, 2 * 1024 * 1024 /* 36 MB for ~2m entries */);
+  __uint(max_entries, 2 * 1024 * 1024 /* 88 MB for ~2m entries */);
   __type(key, struct cid);
   __type(value, struct redirect4);
 } redirect4_map SEC(".maps");
 
+struct
+{
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 1024 * 1024 /* 60 MB for ~1m entries */);
+  __type(key, struct cid);
+  __type(value, struct redirect6);
+} redirect6_map SEC(".maps");
+
+struct usage
+{
+  __u64 packets;
+  __u64 bytes;
+  __u32 cid_len; // set on the CPU that created the entry
+};
+
+struct
+{
+  __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
+  __uint(max_entries, 256 * 1024);
+  __type(key, struct cid);
+  __type(value, struct usage);
+} usage_map SEC(".maps");
+
 struct
 {
   __uint(type, BPF_MAP_TYPE_RINGBUF);
-  __uint(max_entries, 64 * 1024 /* 64kB for ~5k entries */);
+  __uint(max_entries, 64 * 1024 /* 64kB for ~2k entries */);
 } rejected_cids_rb SEC(".maps");
 
 static __always_inline void
@@ -54,10 +181,10 @@ copy_ethaddr(unsigned char dst[6], const unsigned char src[6])
 }
 
 static __always_inline void
-copy_cid(__u8 dst[12], const __u8 src[12])
+copy_cid(__u8 dst[MAX_CID_LEN], const __u8 src[MAX_CID_LEN])
 {
 #pragma clang loop unroll(full)
-  for (int i = 0; i < 12; i += 1) {
+  for (int i = 0; i < MAX_CID_LEN; i += 1) {
     dst[i] = src[i];
   }
 }
@@ -92,12 +219,224 @@ is_http3(const __u8* cid)
   return (cid[0] & 0x80) != 0;
 }
 
+static __always_inline void
+swap_ethaddr(struct ethhdr* eth)
+{
+  unsigned char swp[6];
+  copy_ethaddr(swp, eth->h_source);
+  copy_ethaddr(eth->h_source, eth->h_dest);
+  copy_ethaddr(eth->h_dest, swp);
+}
+
+static __always_inline struct stats*
+get_stats(void)
+{
+  __u32 key = 0;
+
+  return bpf_map_lookup_elem(&stats_map, &key);
+}
+
+static __always_inline void
+count_action(int action, __u64 bytes)
+{
+  struct stats* stats = get_stats();
+
+  if (stats == NULL) {
+    return;
+  }
+
+  switch (action) {
+    case XDP_TX:
+      stats->redirected += 1;
+      stats->redirected_bytes += bytes;
+      break;
+
+    case XDP_PASS:
+      stats->passed += 1;
+      break;
+
+    case XDP_DROP:
+      stats->dropped += 1;
+      break;
+  }
+}
+
+static __always_inline void
+reject_cid(const struct cid* dst, __u8 cidlen)
+{
+  struct stats* stats = get_stats();
+
+  if (stats != NULL) {
+    stats->rejected += 1;
+  }
+
+  struct rejected_cid* rejected =
+    bpf_ringbuf_reserve(&rejected_cids_rb, sizeof(struct rejected_cid), 0);
+
+  if (rejected != NULL) {
+    rejected->len = cidlen;
+    copy_cid(rejected->cid, dst->cid);
+
+    bpf_ringbuf_submit(rejected, 0);
+  }
+}
+
+// allow_source takes a token from the source's bucket, returning 0 if there
+// is none. Buckets are shared between CPUs without locking, so the limit is
+// approximate.
 static __always_inline int
-handle_quic4(struct ethhdr* eth,
-             struct iphdr* ipv4,
-             struct udphdr* udp,
-             void* data,
-             void* data_end)
+allow_source(const struct source* src)
+{
+  __u32 key = 0;
+  struct source_limit_config* config =
+    bpf_map_lookup_elem(&source_limit_config_map, &key);
+
+  if (config == NULL || config->rate == 0) {
+    return 1;
+  }
+
+  __u64 now = bpf_ktime_get_ns();
+  __u64 max = config->burst * NSEC_PER_SEC;
+
+  struct source_limit* limit = bpf_map_lookup_elem(&source_limit_map, src);
+
+  if (limit == NULL) {
+    struct source_limit init = {
+      .tokens = max >= NSEC_PER_SEC ? max - NSEC_PER_SEC : 0,
+      .last = now,
+    };
+
+    bpf_map_update_elem(&source_limit_map, src, &init, BPF_ANY);
+
+    return max >= NSEC_PER_SEC;
+  }
+
+  __u64 elapsed = now - limit->last;
+  __u64 tokens = limit->tokens;
+
+  if (elapsed >= max / config->rate) {
+    tokens = max;
+  } else {
+    tokens += elapsed * config->rate;
+
+    if (tokens > max) {
+      tokens = max;
+    }
+  }
+
+  limit->last = now;
+
+  if (tokens < NSEC_PER_SEC) {
+    limit->tokens = tokens;
+
+    return 0;
+  }
+
+  limit->tokens = tokens - NSEC_PER_SEC;
+
+  return 1;
+}
+
+static __always_inline int
+limit_source(const struct source* src)
+{
+  if (allow_source(src)) {
+    return 0;
+  }
+
+  struct stats* stats = get_stats();
+
+  if (stats != NULL) {
+    stats->limited += 1;
+  }
+
+  return 1;
+}
+
+// verify_source returns 0 if source verification is enabled and the source
+// is not a peer of the session.
+static __always_inline int
+verify_source(const struct source* src, __be16 port, __u64 session)
+{
+  __u32 key = 0;
+  __u32* enabled = bpf_map_lookup_elem(&source_verification_map, &key);
+
+  if (enabled == NULL || *enabled == 0) {
+    return 1;
+  }
+
+  struct peer peer = {};
+  __builtin_memcpy(peer.addr, src->addr, sizeof(peer.addr));
+  peer.port = port;
+  peer.session = session;
+
+  if (bpf_map_lookup_elem(&peer_map, &peer) != NULL) {
+    return 1;
+  }
+
+  struct stats* stats = get_stats();
+
+  if (stats != NULL) {
+    stats->spoofed += 1;
+  }
+
+  return 0;
+}
+
+static __always_inline void
+count_usage(const struct cid* dst, __u8 cidlen, __u64 bytes)
+{
+  struct usage* usage = bpf_map_lookup_elem(&usage_map, dst);
+
+  if (usage == NULL) {
+    struct usage init = {
+      .packets = 1,
+      .bytes = bytes,
+      .cid_len = cidlen,
+    };
+
+    if (bpf_map_update_elem(&usage_map, dst, &init, BPF_NOEXIST) == 0) {
+      return;
+    }
+
+    // created on another CPU in the meantime
+    usage = bpf_map_lookup_elem(&usage_map, dst);
+    if (usage == NULL) {
+      return;
+    }
+  }
+
+  usage->packets += 1;
+  usage->bytes += bytes;
+}
+
+// read_cid copies the CID of cidlen bytes at offset. Returns 0 if the packet
+// is too short.
+static __always_inline int
+read_cid(void* data, void* data_end, int offset, __u8 cidlen, struct cid* dst)
+{
+  __u8* udata = data;
+
+#pragma clang loop unroll(full)
+  for (int i = 0; i < MAX_CID_LEN; i += 1) {
+    if (i >= cidlen) {
+      break;
+    }
+
+    if (data + offset + i + 1 > data_end) {
+      return 0;
+    }
+
+    dst->cid[i] = udata[offset + i];
+  }
+
+  return 1;
+}
+
+// parse_quic copies the destination CID of a QUIC packet which can be
+// redirected to dst. Returns -1 if it can, otherwise the XDP action.
+static __always_inline int
+parse_quic(void* data, void* data_end, __u8 cidlen, struct cid* dst)
 {
   if (data + 1 > data_end) {
     // not a QUIC packet
@@ -111,40 +450,98 @@ handle_quic4(struct ethhdr* eth,
     return XDP_DROP;
   }
 
-  struct cid* dst = NULL;
-
   if ((udata[0] & 0x80) == 0) {
-    // short form
-    if (data + 1 + sizeof(struct cid) > data_end) {
+    // short form: flags, DCID
+    if (!read_cid(data, data_end, 1, cidlen, dst)) {
       // not a QUIC packet
       return XDP_DROP;
     }
 
-    dst = data + 1;
-  } else {
-    // long form packet with weird destination length, send to userspace
+    if (is_http3(dst->cid)) {
+      // destination is HTTP3
+      return XDP_PASS;
+    }
 
+    return -1;
+  }
+
+  // long form: flags, version, DCID length, DCID, SCID length, SCID
+  if (data + 6 > data_end) {
+    // not a QUIC packet
+    return XDP_DROP;
+  }
+
+  if (udata[5] != cidlen) {
+    // not a peer's CID, such as the DCID of a client's Initial packet
     return XDP_PASS;
   }
 
+  if (!read_cid(data, data_end, 6, cidlen, dst)) {
+    // not a QUIC packet
+    return XDP_DROP;
+  }
+
+  __u8* scid = udata + 6 + cidlen;
+
+  if ((void*)(scid + 1) > data_end) {
+    // not a QUIC packet
+    return XDP_DROP;
+  }
+
+  if (scid[0] > 0) {
+    if ((void*)(scid + 2) > data_end) {
+      // not a QUIC packet
+      return XDP_DROP;
+    }
+
+    if (is_http3(scid + 1)) {
+      // source is HTTP3
+      return XDP_PASS;
+    }
+  }
+
   if (is_http3(dst->cid)) {
     // destination is HTTP3
     return XDP_PASS;
   }
 
-  void* r4value = bpf_map_lookup_elem(&redirect4_map, dst);
+  return -1;
+}
+
+static __always_inline int
+handle_quic4(__u8 cidlen,
+             const struct source* src,
+             struct ethhdr* eth,
+             struct iphdr* ipv4,
+             struct udphdr* udp,
+             void* data,
+             void* data_end)
+{
+  struct cid dst = {};
+
+  int action = parse_quic(data, data_end, cidlen, &dst);
+  if (action >= 0) {
+    return action;
+  }
+
+  void* r4value = bpf_map_lookup_elem(&redirect4_map, &dst);
 
   if (r4value != NULL) {
     struct redirect4* r4 = r4value;
 
-    unsigned char swp[6];
-    copy_ethaddr(swp, eth->h_dest);
-    copy_ethaddr(eth->h_source, eth->h_dest);
-    copy_ethaddr(eth->h_dest, swp);
+    if (!verify_source(src, udp->source, r4->session)) {
+      return XDP_DROP;
+    }
+
+    r4->seen = bpf_ktime_get_ns();
+
+    count_usage(&dst, cidlen, data_end - data);
+
+    swap_ethaddr(eth);
 
     ipv4->saddr = ipv4->daddr;
     ipv4->daddr = r4->addr;
-    ipv4->ttl = 64;
+    ipv4->ttl = redirect_ttl;
     ipv4->tos = 0;
     ipv4->id = 0;
     ipv4->frag_off = 0;
@@ -160,18 +557,117 @@ handle_quic4(struct ethhdr* eth,
 
   // unable to find destination to redirect
 
-  void* rejected_cid =
-    bpf_ringbuf_reserve(&rejected_cids_rb, sizeof(struct cid), 0);
+  reject_cid(&dst, cidlen);
+
+  return XDP_DROP;
+}
+
+static __always_inline void
+udp6_checksum_replace(struct udphdr* udp,
+                      const __u16 from_addr[8],
+                      const __u16 to_addr[8],
+                      __be16 from_port,
+                      __be16 to_port)
+{
+  // incremental update from: https://datatracker.ietf.org/doc/html/rfc1624
+  // the destination address and port only move within the pseudo header and
+  // UDP header, so only the replaced source address and port matter
+  __u32 sum = (__u16)~udp->check;
+
+#pragma clang loop unroll(full)
+  for (int i = 0; i < 8; i += 1) {
+    sum += (__u16)~from_addr[i];
+    sum += to_addr[i];
+  }
+
+  sum += (__u16)~from_port;
+  sum += to_port;
+
+  sum = (sum & 0xffff) + (sum >> 16);
+  sum = (sum & 0xffff) + (sum >> 16);
+
+  __u16 check = ~sum;
 
-  if (rejected_cid != NULL) {
-    copy_cid(rejected_cid, dst->cid);
+  // zero means no checksum, which is not allowed over IPv6
+  udp->check = check == 0 ? 0xffff : check;
+}
+
+static __always_inline int
+handle_quic6(__u8 cidlen,
+             const struct source* src,
+             struct ethhdr* eth,
+             struct ipv6hdr* ipv6,
+             struct udphdr* udp,
+             void* data,
+             void* data_end)
+{
+  if (udp->check == 0) {
+    // invalid over IPv6, can't be updated incrementally
+    return XDP_PASS;
+  }
 
-    bpf_ringbuf_submit(rejected_cid, 0);
+  struct cid dst = {};
+
+  int action = parse_quic(data, data_end, cidlen, &dst);
+  if (action >= 0) {
+    return action;
   }
 
+  void* r6value = bpf_map_lookup_elem(&redirect6_map, &dst);
+
+  if (r6value != NULL) {
+    struct redirect6* r6 = r6value;
+
+    if (!verify_source(src, udp->source, r6->session)) {
+      return XDP_DROP;
+    }
+
+    r6->seen = bpf_ktime_get_ns();
+
+    count_usage(&dst, cidlen, data_end - data);
+
+    swap_ethaddr(eth);
+
+    struct in6_addr from_addr = ipv6->saddr;
+    __be16 from_port = udp->source;
+
+    ipv6->saddr = ipv6->daddr;
+    __builtin_memcpy(&ipv6->daddr, r6->addr, sizeof(r6->addr));
+    ipv6->hop_limit = redirect_ttl;
+
+    udp->source = udp->dest;
+    udp->dest = r6->port;
+
+    udp6_checksum_replace(udp,
+                          from_addr.in6_u.u6_addr16,
+                          ipv6->daddr.in6_u.u6_addr16,
+                          from_port,
+                          r6->port);
+
+    return XDP_TX;
+  }
+
+  // unable to find destination to redirect
+
+  reject_cid(&dst, cidlen);
+
   return XDP_DROP;
 }
 
+// quicpipe_cid_len returns the CID length used on the packet's destination
+// port, or 0 if it is not a Quicpipe port.
+static __always_inline __u8
+quicpipe_cid_len(struct udphdr* udp)
+{
+  __u8* cidlen = bpf_map_lookup_elem(&port_map, &(udp->dest));
+
+  if (cidlen == NULL || *cidlen < MIN_CID_LEN || *cidlen > MAX_CID_LEN) {
+    return 0;
+  }
+
+  return *cidlen;
+}
+
 static __always_inline int
 handle_udp4(struct ethhdr* eth, struct iphdr* ipv4, void* data, void* data_end)
 {
@@ -181,14 +677,64 @@ handle_udp4(struct ethhdr* eth, struct iphdr* ipv4, void* data, void* data_end)
 
   struct udphdr* udp = data;
 
-  void* portvalue = bpf_map_lookup_elem(&port_map, &(udp->dest));
+  __u8 cidlen = quicpipe_cid_len(udp);
 
-  if (portvalue == NULL) {
+  if (cidlen == 0) {
     // not a Quicpipe packet
     return XDP_PASS;
   }
 
-  return handle_quic4(eth, ipv4, udp, data + sizeof(struct udphdr), data_end);
+  struct source src = {
+    .addr = { [10] = 0xff, [11] = 0xff },
+  };
+  __builtin_memcpy(&src.addr[12], &ipv4->saddr, sizeof(ipv4->saddr));
+
+  if (limit_source(&src)) {
+    return XDP_DROP;
+  }
+
+  data += sizeof(struct udphdr);
+
+  int action = handle_quic4(cidlen, &src, eth, ipv4, udp, data, data_end);
+
+  count_action(action, data_end - data);
+
+  return action;
+}
+
+static __always_inline int
+handle_udp6(struct ethhdr* eth,
+            struct ipv6hdr* ipv6,
+            void* data,
+            void* data_end)
+{
+  if (data + sizeof(struct udphdr) > data_end) {
+    return XDP_PASS;
+  }
+
+  struct udphdr* udp = data;
+
+  __u8 cidlen = quicpipe_cid_len(udp);
+
+  if (cidlen == 0) {
+    // not a Quicpipe packet
+    return XDP_PASS;
+  }
+
+  struct source src = {};
+  __builtin_memcpy(src.addr, &ipv6->saddr, sizeof(src.addr));
+
+  if (limit_source(&src)) {
+    return XDP_DROP;
+  }
+
+  data += sizeof(struct udphdr);
+
+  int action = handle_quic6(cidlen, &src, eth, ipv6, udp, data, data_end);
+
+  count_action(action, data_end - data);
+
+  return action;
 }
 
 static __always_inline int
@@ -217,7 +763,17 @@ handle_ipv4(struct ethhdr* eth, void* data, void* data_end)
 static __always_inline int
 handle_ipv6(struct ethhdr* eth, void* data, void* data_end)
 {
-  // not supported
+  if (data + sizeof(struct ipv6hdr) > data_end) {
+    return XDP_PASS;
+  }
+
+  struct ipv6hdr* ipv6 = data;
+
+  if (ipv6->nexthdr == 0x11) {
+    // UDP, extension headers are not supported
+    return handle_udp6(eth, ipv6, data + sizeof(struct ipv6hdr), data_end);
+  }
+
   return XDP_PASS;
 }
 
@@ -4,42 +4,150 @@ package xdp
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/ringbuf"
 )
 
+const (
+	// DefaultCIDLength is the CID length used by AttachPort, the same as
+	// quicpipe.StandardQUICConnectionIDLength.
+	DefaultCIDLength = 12
+
+	MinCIDLength = 4
+	MaxCIDLength = 20
+)
+
+// ErrCIDLength is returned by AttachPortCIDLength for unsupported lengths.
+var ErrCIDLength = errors.New("quicpipe/xdp: CID length must be between 4 and 20 bytes")
+
+// ErrMalformedRejectedCID is returned by ReadRejectedCID for records it can't
+// decode.
+var ErrMalformedRejectedCID = errors.New("quicpipe/xdp: malformed rejected CID record")
+
+// pinnedMaps are the maps reused by OpenPinned. The others, such as the
+// counters, start empty on each Open.
+var pinnedMaps = []string{
+	"port_map",
+	"redirect4_map",
+	"redirect6_map",
+	"peer_map",
+	"source_verification_map",
+	"source_limit_config_map",
+	"rejected_cids_rb",
+}
+
 // XDPLink lets you interact with Quicpipe's eBPF XDP filter.
 type XDPLink struct {
 	objs  quicpipexdpObjects
 	links []link.Link
 
+	// pinPath is set by OpenPinned
+	pinPath string
+
+	cidlen int
+
 	rbreader *ringbuf.Reader
 	rbpool   sync.Pool
 }
 
-// Open loads the eBPF code. You should call Attach and AttachPort to load the
-// code on an interface and activate it on a UDP port.
-func Open() (*XDPLink, error) {
-	link := &XDPLink{}
+// Open loads the eBPF code, configured with the options if not nil. You
+// should call Attach and AttachPort to load the code on an interface and
+// activate it on a UDP port.
+func Open(opts *Options) (*XDPLink, error) {
+	spec, err := loadSpec(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(spec, nil, "", opts)
+}
+
+// OpenPinned is like Open, but pins the redirect, port, peer and
+// configuration maps and the rejected CID ring buffer under the path on a
+// bpffs, such as /sys/fs/bpf/quicpipe, reusing those pinned by a previous
+// OpenPinned. Attach pins the interface's XDP link there as well, and
+// replaces the program of a previously pinned one atomically, so a relay can
+// be restarted or upgraded without losing its redirects or dropping packets
+// in between. Pinned maps and links outlive Close; use Unpin to remove them.
+// If the maps were pinned by a version with a different layout, it returns
+// an error, and they need to be unpinned first.
+func OpenPinned(path string, opts *Options) (*XDPLink, error) {
+	spec, err := loadSpec(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range pinnedMaps {
+		spec.Maps[name].Pinning = ebpf.PinByName
+	}
+
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+
+	return open(spec, &ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{
+			PinPath: path,
+		},
+	}, path, opts)
+}
+
+func loadSpec(opts *Options) (*ebpf.CollectionSpec, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	spec, err := loadQuicpipexdp()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.apply(spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+func open(spec *ebpf.CollectionSpec, collectionOpts *ebpf.CollectionOptions, pinPath string, opts *Options) (*XDPLink, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	link := &XDPLink{
+		pinPath: pinPath,
+		cidlen:  opts.cidLength(),
+	}
 
-	if err := loadQuicpipexdpObjects(&link.objs, nil); err != nil {
+	if err := spec.LoadAndAssign(&link.objs, collectionOpts); err != nil {
 		return nil, err
 	}
 
 	rbreader, err := ringbuf.NewReader(link.objs.RejectedCidsRb)
 	if err != nil {
+		link.objs.Close()
 		return nil, err
 	}
 
 	link.rbreader = rbreader
 	link.rbpool.New = func() interface{} {
 		return &ringbuf.Record{
-			RawSample: make([]byte, 12),
+			RawSample: make([]byte, 1+MaxCIDLength),
 		}
 	}
 
@@ -61,7 +169,8 @@ func (e ErrXDPLinkClose) Error() string {
 	return "qucket/xdp: close failed: " + strings.Join(errs, ", ")
 }
 
-// Close closes the eBPF XDP filter, releasing it from all attached interfaces.
+// Close closes the eBPF XDP filter, releasing it from all attached interfaces,
+// unless it was attached with OpenPinned.
 func (l *XDPLink) Close() error {
 	var errors []error
 	for _, link := range l.links {
@@ -85,6 +194,10 @@ func (l *XDPLink) Close() error {
 
 // Attach attaches the eBPF filter to the provided interface.
 func (l *XDPLink) Attach(iface *net.Interface) error {
+	if l.pinPath != "" {
+		return l.attachPinned(iface)
+	}
+
 	link, err := link.AttachXDP(link.XDPOptions{
 		Program:   l.objs.XdpQuicpipe,
 		Interface: iface.Index,
@@ -98,6 +211,73 @@ func (l *XDPLink) Attach(iface *net.Interface) error {
 	return nil
 }
 
+// attachPinned updates the XDP link pinned for the interface with the
+// program, or attaches and pins a new one.
+func (l *XDPLink) attachPinned(iface *net.Interface) error {
+	path := filepath.Join(l.pinPath, "link_"+strconv.Itoa(iface.Index))
+
+	pinned, err := link.LoadPinnedLink(path, nil)
+	if err == nil {
+		// the previous program keeps running until it is replaced
+		if err := pinned.Update(l.objs.XdpQuicpipe); err != nil {
+			pinned.Close()
+			return err
+		}
+
+		l.links = append(l.links, pinned)
+
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	attached, err := link.AttachXDP(link.XDPOptions{
+		Program:   l.objs.XdpQuicpipe,
+		Interface: iface.Index,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := attached.Pin(path); err != nil {
+		attached.Close()
+		return err
+	}
+
+	l.links = append(l.links, attached)
+
+	return nil
+}
+
+// Unpin removes the maps and links pinned by OpenPinned and Attach, so that
+// Close detaches the filter and frees them. Use it when the relay is shut
+// down for good.
+func (l *XDPLink) Unpin() error {
+	for _, link := range l.links {
+		if err := link.Unpin(); err != nil {
+			return err
+		}
+	}
+
+	maps := []*ebpf.Map{
+		l.objs.PortMap,
+		l.objs.Redirect4Map,
+		l.objs.Redirect6Map,
+		l.objs.PeerMap,
+		l.objs.SourceVerificationMap,
+		l.objs.SourceLimitConfigMap,
+		l.objs.RejectedCidsRb,
+	}
+
+	for _, m := range maps {
+		if err := m.Unpin(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func htons(i uint16) uint16 {
 	var arr [2]byte
 	b := arr[:]
@@ -113,9 +293,19 @@ func htonl(i uint32) uint32 {
 }
 
 // AttachPort activates the eBPF filter on the provided UDP port on all
-// attached interfaces.
+// attached interfaces, for CIDs of Options.CIDLength or DefaultCIDLength.
 func (l *XDPLink) AttachPort(port uint16) error {
-	return l.objs.PortMap.Put(htons(port), uint8(1))
+	return l.AttachPortCIDLength(port, l.cidlen)
+}
+
+// AttachPortCIDLength is like AttachPort, for a relay using CIDs of the
+// provided length on the port.
+func (l *XDPLink) AttachPortCIDLength(port uint16, cidlen int) error {
+	if cidlen < MinCIDLength || cidlen > MaxCIDLength {
+		return ErrCIDLength
+	}
+
+	return l.objs.PortMap.Put(htons(port), uint8(cidlen))
 }
 
 // DetachPort deactivates the eBPF filter on the provided UDP port on all
@@ -124,13 +314,155 @@ func (l *XDPLink) DetachPort(port uint16) error {
 	return l.objs.PortMap.Delete(htons(port))
 }
 
+// SetSourceRateLimit limits the packets accepted on attached ports from each
+// source IP address to rate per second, with bursts of burst packets. The
+// buckets are kept in a LRU map shared by all CPUs without locking, so the
+// limit is approximate. A rate of 0 disables the limit.
+func (l *XDPLink) SetSourceRateLimit(rate, burst uint64) error {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return l.objs.SourceLimitConfigMap.Put(uint32(0), quicpipexdpSourceLimitConfig{
+		Rate:  rate,
+		Burst: burst,
+	})
+}
+
+// SetSourceVerification enables or disables source verification. When
+// enabled, packets are only redirected if their source was added with AddPeer
+// for the session of the redirect, and dropped otherwise.
+func (l *XDPLink) SetSourceVerification(enabled bool) error {
+	var value uint32
+	if enabled {
+		value = 1
+	}
+
+	return l.objs.SourceVerificationMap.Put(uint32(0), value)
+}
+
+func peerKey(addr *net.UDPAddr, session uint64) quicpipexdpPeer {
+	var key quicpipexdpPeer
+	copy(key.Addr[:], addr.IP.To16())
+	key.Port = htons(uint16(addr.Port))
+	key.Session = session
+
+	return key
+}
+
+// AddPeer allows packets from the UDP address to redirects added for the
+// session, or to redirects without a session if it is 0.
+func (l *XDPLink) AddPeer(addr *net.UDPAddr, session uint64) error {
+	return l.objs.PeerMap.Put(peerKey(addr, session), uint8(1))
+}
+
+// RemovePeer removes a peer added with AddPeer. Peers that were not added are
+// ignored.
+func (l *XDPLink) RemovePeer(addr *net.UDPAddr, session uint64) error {
+	if err := l.objs.PeerMap.Delete(peerKey(addr, session)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// CIDError is the error of one CID in a batch.
+type CIDError struct {
+	CID []byte
+	Err error
+}
+
+// ErrBatch is returned when some of the CIDs in a batch failed. The others
+// succeeded.
+type ErrBatch struct {
+	Errors []CIDError
+}
+
+func (e ErrBatch) Error() string {
+	var errs []string
+	for _, err := range e.Errors {
+		errs = append(errs, fmt.Sprintf("%x: %v", err.CID, err.Err))
+	}
+
+	return "quicpipe/xdp: batch failed: " + strings.Join(errs, ", ")
+}
+
+// Unwrap returns the errors of the failed CIDs, so that errors.Is and
+// errors.As match them.
+func (e ErrBatch) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err.Err)
+	}
+
+	return errs
+}
+
+// batch applies an operation to all CIDs, with a batch syscall starting at
+// an index where the kernel supports it (Linux 5.6), and one syscall per CID
+// otherwise. The CID a batch stops at is retried alone to find its error,
+// and the batch continues after it.
+func batch(cids [][]byte, batchOp func(start int) (int, error), op func(i int) error) error {
+	var errs []CIDError
+
+	batched := true
+
+	for i := 0; i < len(cids); i += 1 {
+		if batched {
+			n, err := batchOp(i)
+			if err == nil {
+				break
+			}
+
+			if errors.Is(err, ebpf.ErrNotSupported) {
+				batched = false
+			} else {
+				i += n
+			}
+		}
+
+		if err := op(i); err != nil {
+			errs = append(errs, CIDError{
+				CID: cids[i],
+				Err: err,
+			})
+		}
+	}
+
+	if len(errs) > 0 {
+		return ErrBatch{
+			Errors: errs,
+		}
+	}
+
+	return nil
+}
+
+func cidKeys(cids [][]byte) []quicpipexdpCid {
+	keys := make([]quicpipexdpCid, len(cids))
+
+	for i, cid := range cids {
+		copy(keys[i].Cid[:], cid)
+	}
+
+	return keys
+}
+
 // AddIPv4Redirect adds the UDP address to the IPv4 redirect map of the eBPF
 // filter for all of the provided CIDs. The UDP address is assumed to be IPv4.
 func (l *XDPLink) AddIPv4Redirect(addr *net.UDPAddr, cids ...[]byte) error {
+	return l.AddIPv4RedirectSession(addr, 0, cids...)
+}
+
+// AddIPv4RedirectSession is like AddIPv4Redirect, but with source
+// verification only peers of the session may send to the CIDs. CIDs are added
+// in one batch where possible, and ErrBatch lists those that failed.
+func (l *XDPLink) AddIPv4RedirectSession(addr *net.UDPAddr, session uint64, cids ...[]byte) error {
 	ip := addr.IP.To4()
 
 	var value quicpipexdpRedirect4
 	value.Port = htons(uint16(addr.Port))
+	value.Session = session
 	value.Addr = htonl(
 		0 |
 			(uint32(ip[0]) << 3 * 8) |
@@ -138,29 +470,219 @@ func (l *XDPLink) AddIPv4Redirect(addr *net.UDPAddr, cids ...[]byte) error {
 			(uint32(ip[2]) << 1 * 8) |
 			(uint32(ip[3]) << 0 * 8))
 
-	for _, cid := range cids {
-		var key quicpipexdpCid
-		copy(key.Cid[:], cid)
+	keys := cidKeys(cids)
 
-		// in the future maybe use the batch API
-		if err := l.objs.Redirect4Map.Put(key, value); err != nil {
-			return err
-		}
+	values := make([]quicpipexdpRedirect4, len(keys))
+	for i := range values {
+		values[i] = value
 	}
 
-	return nil
+	return batch(cids, func(start int) (int, error) {
+		return l.objs.Redirect4Map.BatchUpdate(keys[start:], values[start:], nil)
+	}, func(i int) error {
+		return l.objs.Redirect4Map.Put(keys[i], values[i])
+	})
+}
+
+// AddIPv6Redirect adds the UDP address to the IPv6 redirect map of the eBPF
+// filter for all of the provided CIDs. The UDP address is assumed to be IPv6.
+func (l *XDPLink) AddIPv6Redirect(addr *net.UDPAddr, cids ...[]byte) error {
+	return l.AddIPv6RedirectSession(addr, 0, cids...)
 }
 
-// RemoveIPv4Redirect removes any redirects assigned to the provided CIDs.
+// AddIPv6RedirectSession is like AddIPv4RedirectSession, for IPv6.
+func (l *XDPLink) AddIPv6RedirectSession(addr *net.UDPAddr, session uint64, cids ...[]byte) error {
+	var value quicpipexdpRedirect6
+	value.Port = htons(uint16(addr.Port))
+	value.Session = session
+	copy(value.Addr[:], addr.IP.To16())
+
+	keys := cidKeys(cids)
+
+	values := make([]quicpipexdpRedirect6, len(keys))
+	for i := range values {
+		values[i] = value
+	}
+
+	return batch(cids, func(start int) (int, error) {
+		return l.objs.Redirect6Map.BatchUpdate(keys[start:], values[start:], nil)
+	}, func(i int) error {
+		return l.objs.Redirect6Map.Put(keys[i], values[i])
+	})
+}
+
+// RemoveIPv4Redirect removes any IPv4 redirects assigned to the provided CIDs.
+// CIDs without a redirect (for example evicted from the LRU map) are ignored.
+// CIDs are removed in one batch where possible, and ErrBatch lists those that
+// failed.
 func (l *XDPLink) RemoveIPv4Redirect(cids ...[]byte) error {
+	return l.removeRedirect(l.objs.Redirect4Map, cids)
+}
+
+// RemoveIPv6Redirect is like RemoveIPv4Redirect, for IPv6.
+func (l *XDPLink) RemoveIPv6Redirect(cids ...[]byte) error {
+	return l.removeRedirect(l.objs.Redirect6Map, cids)
+}
+
+func (l *XDPLink) removeRedirect(m *ebpf.Map, cids [][]byte) error {
+	keys := cidKeys(cids)
+
+	// a batch stops at CIDs without a redirect, which are ignored alone
+	return batch(cids, func(start int) (int, error) {
+		return m.BatchDelete(keys[start:], nil)
+	}, func(i int) error {
+		if err := m.Delete(keys[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// LastRedirect returns the kernel's monotonic clock (in nanoseconds) at the
+// time the eBPF filter last redirected a packet for any of the provided CIDs,
+// or 0 if it never did. Use it to detect whether a redirect is being used
+// between two calls, as it is not comparable to wall-clock time.
+func (l *XDPLink) LastRedirect(cids ...[]byte) (uint64, error) {
+	var last uint64
+
 	for _, cid := range cids {
 		var key quicpipexdpCid
 		copy(key.Cid[:], cid)
 
-		// in the future maybe use the batch API
-		if err := l.objs.Redirect4Map.Delete(key); err != nil {
+		var value4 quicpipexdpRedirect4
+		if err := l.objs.Redirect4Map.Lookup(key, &value4); err == nil {
+			if value4.Seen > last {
+				last = value4.Seen
+			}
+
+			continue
+		} else if !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return 0, err
+		}
+
+		var value6 quicpipexdpRedirect6
+		if err := l.objs.Redirect6Map.Lookup(key, &value6); err == nil {
+			if value6.Seen > last {
+				last = value6.Seen
+			}
+		} else if !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return 0, err
+		}
+	}
+
+	return last, nil
+}
+
+// Stats are the eBPF filter's counters for packets on attached ports, summed
+// over all CPUs.
+type Stats struct {
+	// Redirected packets were sent back out of the NIC to a peer.
+	Redirected uint64
+
+	// RedirectedBytes is the UDP payload size of redirected packets.
+	RedirectedBytes uint64
+
+	// Passed packets were passed to the network stack, such as those of
+	// the relay's HTTP/3 server.
+	Passed uint64
+
+	// Dropped packets were not QUIC packets, or were rejected.
+	Dropped uint64
+
+	// Rejected packets had no redirect for their CID, which was sent to
+	// the rejected CID ring buffer.
+	Rejected uint64
+
+	// Limited packets were dropped by the source rate limit. They are not
+	// counted as dropped.
+	Limited uint64
+
+	// Spoofed packets were dropped by source verification, as their
+	// source was not a peer of the redirect's session.
+	Spoofed uint64
+}
+
+// Stats reads the eBPF filter's counters.
+func (l *XDPLink) Stats() (Stats, error) {
+	var values []quicpipexdpStats
+
+	if err := l.objs.StatsMap.Lookup(uint32(0), &values); err != nil {
+		return Stats{}, err
+	}
+
+	var stats Stats
+
+	for _, value := range values {
+		stats.Redirected += value.Redirected
+		stats.RedirectedBytes += value.RedirectedBytes
+		stats.Passed += value.Passed
+		stats.Dropped += value.Dropped
+		stats.Rejected += value.Rejected
+		stats.Limited += value.Limited
+		stats.Spoofed += value.Spoofed
+	}
+
+	return stats, nil
+}
+
+// HarvestUsage calls fn with the packets and bytes redirected for each CID
+// since the last harvest, summed over all CPUs, and resets them. The CID bytes
+// are available only for the duration of the function. The counters are kept
+// in a LRU map, so harvest regularly.
+func (l *XDPLink) HarvestUsage(fn func(cid []byte, packets, bytes uint64)) error {
+	var (
+		key    quicpipexdpCid
+		values []quicpipexdpUsage
+		keys   []quicpipexdpCid
+	)
+
+	iter := l.objs.UsageMap.Iterate()
+	for iter.Next(&key, &values) {
+		keys = append(keys, key)
+	}
+
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := l.objs.UsageMap.LookupAndDelete(key, &values)
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			// kernels before 5.14 can't do this for hash maps, so
+			// packets in between are lost
+			err = l.objs.UsageMap.Lookup(key, &values)
+			if err == nil {
+				err = l.objs.UsageMap.Delete(key)
+			}
+		}
+
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			// evicted in the meantime
+			continue
+		} else if err != nil {
 			return err
 		}
+
+		var (
+			packets, bytes uint64
+			cidlen         uint32
+		)
+
+		for _, value := range values {
+			packets += value.Packets
+			bytes += value.Bytes
+
+			if value.CidLen > cidlen {
+				cidlen = value.CidLen
+			}
+		}
+
+		if cidlen < MinCIDLength || cidlen > MaxCIDLength {
+			continue
+		}
+
+		fn(key.Cid[:cidlen], packets, bytes)
 	}
 
 	return nil
@@ -185,5 +707,11 @@ func (l *XDPLink) ReadRejectedCID(fn func(cid []byte) error) error {
 		return err
 	}
 
-	return fn(record.RawSample)
+	// the CID length followed by the CID, padded to MaxCIDLength
+	sample := record.RawSample
+	if len(sample) < 1 || len(sample) < 1+int(sample[0]) {
+		return ErrMalformedRejectedCID
+	}
+
+	return fn(sample[1 : 1+int(sample[0])])
 }